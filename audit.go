@@ -0,0 +1,207 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package redisbackendhttpsessionstore
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+// AuditEvent is a session lifecycle event recorded by the audit sink.
+type AuditEvent string
+
+const (
+	AuditCreated       AuditEvent = "created"
+	AuditAuthenticated AuditEvent = "authenticated"
+	AuditRotated       AuditEvent = "rotated"
+	AuditRevoked       AuditEvent = "revoked"
+	AuditDestroyed     AuditEvent = "destroyed"
+)
+
+// OpAudit is the operation reported to Metrics and Logger for audit writes.
+const OpAudit = "audit"
+
+// AuditConfig configures the audit sink.
+type AuditConfig struct {
+	// Stream is the key of the Redis stream. It defaults to "audit_"
+	// followed by the session key prefix, outside the session prefix like
+	// the other helper keys.
+	Stream string
+	// MaxLen caps the stream approximately, defaults to 100000 entries.
+	MaxLen int64
+}
+
+// AuditRecord is one entry of the audit stream.
+type AuditRecord struct {
+	// ID is the stream entry ID, usable as a cursor for AuditReader.
+	ID    string
+	Time  time.Time
+	Event AuditEvent
+	// Session is the hash of the session ID, as logged by the store.
+	Session   string
+	Name      string
+	IP        string
+	UserAgent string
+	// Attrs holds the extra attributes given to Audit.
+	Attrs map[string]string
+}
+
+// auditAddScript appends an entry to a capped stream. ARGV[1] is the cap,
+// the rest are field/value pairs.
+const auditAddScript = `
+return redis.call('XADD', KEYS[1], 'MAXLEN', '~', ARGV[1], '*', unpack(ARGV, 2))`
+
+// auditRangeScript reads entries after an exclusive start ID, which needs
+// Redis 6.2 or later.
+const auditRangeScript = `
+return redis.call('XRANGE', KEYS[1], ARGV[1], '+', 'COUNT', ARGV[2])`
+
+// EnableAudit turns on the audit sink. From then on the store records
+// AuditCreated when Save assigns a new ID and AuditDestroyed when Save
+// deletes a session; other events are recorded by the application through
+// Audit.
+func (s *SentinelFailoverStore) EnableAudit(config AuditConfig) {
+	if config.Stream == "" {
+		config.Stream = "audit_" + s.keyPrefix
+	}
+	if config.MaxLen <= 0 {
+		config.MaxLen = 100000
+	}
+	s.audit = &config
+}
+
+// Audit records event for session. attrs are extra name/value pairs
+// stored with the entry. It is a no-op unless EnableAudit was called.
+func (s *SentinelFailoverStore) Audit(r *http.Request, session *sessions.Session, event AuditEvent, attrs ...string) error {
+	if s.audit == nil {
+		return nil
+	}
+	if len(attrs)%2 != 0 {
+		return errors.New("SessionStore: audit attributes must be name/value pairs")
+	}
+	args := []string{
+		strconv.FormatInt(s.audit.MaxLen, 10),
+		"event", string(event),
+		"time", strconv.FormatInt(time.Now().UnixNano(), 10),
+		"session", hashID(session.ID),
+		"name", session.Name(),
+	}
+	if r != nil {
+		args = append(args, "ip", s.clientIP(r), "user_agent", r.UserAgent())
+	}
+	for i := 0; i < len(attrs); i += 2 {
+		args = append(args, "attr."+attrs[i], attrs[i+1])
+	}
+	err := s.FailoverClient.Eval(auditAddScript, []string{s.audit.Stream}, args).Err()
+	if err != nil {
+		s.metrics.Error(OpAudit, ErrKindRedis)
+		s.logError(requestContext(r), OpAudit, session.ID, "audit event could not be recorded", err,
+			"event", string(event))
+	}
+	return err
+}
+
+// AuditReader reads the audit stream in order. It keeps its position, so
+// consumers can poll Next to follow the stream.
+type AuditReader struct {
+	store *SentinelFailoverStore
+	last  string
+}
+
+// AuditReader returns a reader positioned after the entry with ID after.
+// Use "" or "0" to read from the start of the stream.
+func (s *SentinelFailoverStore) AuditReader(after string) *AuditReader {
+	if after == "" {
+		after = "0"
+	}
+	return &AuditReader{store: s, last: after}
+}
+
+// Next returns up to count entries following the last one returned. It
+// returns an empty slice when the reader is at the end of the stream.
+func (a *AuditReader) Next(count int64) ([]AuditRecord, error) {
+	s := a.store
+	if s.audit == nil {
+		return nil, errors.New("SessionStore: audit is not enabled")
+	}
+	reply, err := s.FailoverClient.Eval(auditRangeScript, []string{s.audit.Stream},
+		[]string{"(" + a.last, strconv.FormatInt(count, 10)}).Result()
+	if err != nil {
+		return nil, err
+	}
+	entries, _ := reply.([]interface{})
+	records := make([]AuditRecord, 0, len(entries))
+	for _, entry := range entries {
+		record, ok := parseAuditEntry(entry)
+		if !ok {
+			continue
+		}
+		records = append(records, record)
+		a.last = record.ID
+	}
+	return records, nil
+}
+
+// Last returns the ID of the last entry returned by Next.
+func (a *AuditReader) Last() string {
+	return a.last
+}
+
+func parseAuditEntry(entry interface{}) (AuditRecord, bool) {
+	var record AuditRecord
+	pair, ok := entry.([]interface{})
+	if !ok || len(pair) != 2 {
+		return record, false
+	}
+	record.ID, _ = pair[0].(string)
+	for name, value := range replyFields(pair[1]) {
+		switch {
+		case name == "event":
+			record.Event = AuditEvent(value)
+		case name == "time":
+			if ns, err := strconv.ParseInt(value, 10, 64); err == nil {
+				record.Time = time.Unix(0, ns)
+			}
+		case name == "session":
+			record.Session = value
+		case name == "name":
+			record.Name = value
+		case name == "ip":
+			record.IP = value
+		case name == "user_agent":
+			record.UserAgent = value
+		case strings.HasPrefix(name, "attr."):
+			if record.Attrs == nil {
+				record.Attrs = make(map[string]string)
+			}
+			record.Attrs[strings.TrimPrefix(name, "attr.")] = value
+		}
+	}
+	return record, true
+}
+
+// remoteIP returns the address of the peer of r without the port.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,364 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package redisbackendhttpsessionstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"gopkg.in/redis.v3"
+)
+
+type batchContextKey struct{}
+
+// saveBatch is the set of sessions GetMulti returned for a request, which
+// the first Save of any of them writes in one pipeline.
+type saveBatch struct {
+	mu       sync.Mutex
+	sessions []*sessions.Session
+	// flushed holds the sessions as the batch wrote them, it is nil until
+	// the first Save.
+	flushed map[*sessions.Session]flushedSession
+}
+
+// flushedSession is a session as it was written, to tell whether it
+// changed since.
+type flushedSession struct {
+	id      string
+	options sessions.Options
+	data    []byte
+}
+
+// GetMulti returns the named sessions of r, fetching all their keys in a
+// single MGET instead of one GET per session, and registers them in the
+// request's sessions.Registry like Get. Errors of single sessions are
+// joined, the map holds a session for every name regardless.
+//
+// The sessions form a batch: the first Save of any of them, e.g. through
+// sessions.Save(r, w), writes all of them in one pipeline, see SaveMulti.
+// Later saves of a batch member write it again on its own if it changed
+// since, e.g. a logout after the batch was saved, and do nothing
+// otherwise.
+func (s *SentinelFailoverStore) GetMulti(r *http.Request, names ...string) (map[string]*sessions.Session, error) {
+	registry := sessions.GetRegistry(r)
+	var store sessions.Store = s
+	if s.Ready() {
+		if values := s.prefetch(r, names); values != nil {
+			store = prefetchStore{SentinelFailoverStore: s, values: values}
+		}
+	}
+
+	result := make(map[string]*sessions.Session, len(names))
+	var errs []error
+	for _, name := range names {
+		session, err := registry.Get(store, name)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+		if session != nil {
+			// Hand the session back to the store itself, the registry
+			// keeps the store of the last Get.
+			registry.Get(s, name)
+			result[name] = session
+		}
+	}
+
+	batch, _ := r.Context().Value(batchContextKey{}).(*saveBatch)
+	if batch == nil {
+		batch = &saveBatch{}
+		*r = *r.WithContext(context.WithValue(r.Context(), batchContextKey{}, batch))
+	}
+	batch.mu.Lock()
+	defer batch.mu.Unlock()
+next:
+	for _, name := range names {
+		session := result[name]
+		if session == nil {
+			continue
+		}
+		for _, known := range batch.sessions {
+			if known == session {
+				continue next
+			}
+		}
+		batch.sessions = append(batch.sessions, session)
+		s.enlist(r.Context(), session, batch)
+	}
+	return result, errors.Join(errs...)
+}
+
+// enlist makes Save find the batch of session. The gorilla Registry saves
+// with the request it was created for, which does not carry the batch in
+// its context, so batches are looked up by session until the request is
+// done. A request context that is never done gets no batch saves.
+func (s *SentinelFailoverStore) enlist(ctx context.Context, session *sessions.Session, batch *saveBatch) {
+	if ctx.Done() == nil {
+		return
+	}
+	s.batches.Store(session, batch)
+	context.AfterFunc(ctx, func() {
+		s.batches.Delete(session)
+	})
+}
+
+// saveBatched saves the batch of session if it has one, and reports
+// whether it did.
+func (s *SentinelFailoverStore) saveBatched(r *http.Request, w http.ResponseWriter, session *sessions.Session) (bool, error) {
+	batch, ok := s.batches.Load(session)
+	if !ok {
+		return false, nil
+	}
+	return true, batch.(*saveBatch).save(s, r, w, session)
+}
+
+// save writes all sessions of the batch in one pipeline the first time,
+// afterwards it writes session, or every session of the batch if nil, on
+// its own if it changed since it was written.
+func (b *saveBatch) save(s *SentinelFailoverStore, r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.flushed == nil {
+		b.flushed = make(map[*sessions.Session]flushedSession, len(b.sessions))
+		err := s.SaveMulti(r, w, b.sessions...)
+		if err == nil {
+			// Sessions of a failed flush are written again by the
+			// next Save.
+			for _, session := range b.sessions {
+				b.record(s, session)
+			}
+		}
+		return err
+	}
+	list := b.sessions
+	if session != nil {
+		list = []*sessions.Session{session}
+	}
+	var errs []error
+	for _, session := range list {
+		if !b.changed(s, session) {
+			continue
+		}
+		err := s.saveOne(r, w, session)
+		if err == nil {
+			b.record(s, session)
+		}
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// record remembers session as it was written.
+func (b *saveBatch) record(s *SentinelFailoverStore, session *sessions.Session) {
+	data, err := s.serializer.Serialize(s.withoutFields(session))
+	if err != nil || session.Options == nil {
+		delete(b.flushed, session)
+		return
+	}
+	b.flushed[session] = flushedSession{id: session.ID, options: *session.Options, data: data}
+}
+
+// changed reports whether session differs from the one recorded when it
+// was written. Serialized maps do not keep their order, so values are
+// compared decoded when the bytes differ.
+func (b *saveBatch) changed(s *SentinelFailoverStore, session *sessions.Session) bool {
+	flushed, ok := b.flushed[session]
+	if !ok || session.Options == nil || flushed.id != session.ID || flushed.options != *session.Options {
+		return true
+	}
+	data, err := s.serializer.Serialize(s.withoutFields(session))
+	if err != nil {
+		return true
+	}
+	if bytes.Equal(data, flushed.data) {
+		return false
+	}
+	before := sessions.NewSession(s, session.Name())
+	after := sessions.NewSession(s, session.Name())
+	if s.serializer.Deserialize(flushed.data, before) != nil || s.serializer.Deserialize(data, after) != nil {
+		return true
+	}
+	return !reflect.DeepEqual(before.Values, after.Values)
+}
+
+// prefetchKey holds the values prefetched by GetMulti in the context of
+// the request passed to New.
+type prefetchKey struct{}
+
+// prefetchStore hands the values prefetched by GetMulti to New. It only
+// lives for the duration of GetMulti, so nothing outlives the call.
+type prefetchStore struct {
+	*SentinelFailoverStore
+	values map[string]storedSession
+}
+
+func (p prefetchStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	return p.SentinelFailoverStore.New(r.WithContext(context.WithValue(r.Context(), prefetchKey{}, p.values)), name)
+}
+
+// prefetch reads the keys of the named sessions with one MGET, and their
+// atomic fields in the same pipeline, and returns them by session ID, with
+// nil data for a missing key. A failed read returns nothing, the sessions
+// are then read one by one and report the error themselves.
+func (s *SentinelFailoverStore) prefetch(r *http.Request, names []string) map[string]storedSession {
+	var ids, keys []string
+	for _, name := range names {
+		value, _, ok := s.readSession(r, name)
+		if !ok {
+			continue
+		}
+		var id string
+		if securecookie.DecodeMulti(name, value, &id, s.codecs()...) == nil && s.validID(id) {
+			ids = append(ids, id)
+			keys = append(keys, s.sessionKey(id))
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	start := time.Now()
+	pipe := s.FailoverClient.Pipeline()
+	defer pipe.Close()
+	mget := pipe.MGet(keys...)
+	var hashes []*redis.StringStringMapCmd
+	if len(s.atomicFields) > 0 {
+		for _, id := range ids {
+			hashes = append(hashes, pipe.HGetAllMap(s.fieldsKey(s.storageID(id))))
+		}
+	}
+	_, err := pipe.Exec()
+	s.metrics.Redis(OpLoad, time.Since(start))
+	if err != nil {
+		return nil
+	}
+	values := mget.Val()
+	if len(values) != len(ids) {
+		return nil
+	}
+	prefetched := make(map[string]storedSession, len(ids))
+	for i, v := range values {
+		var stored storedSession
+		if str, ok := v.(string); ok {
+			stored.data = []byte(str)
+		}
+		if hashes != nil {
+			stored.fields = hashes[i].Val()
+		}
+		prefetched[ids[i]] = stored
+	}
+	return prefetched
+}
+
+// prefetched returns what GetMulti prefetched for a session, with nil data
+// if its key did not exist.
+func prefetched(ctx context.Context, id string) (storedSession, bool) {
+	values, _ := ctx.Value(prefetchKey{}).(map[string]storedSession)
+	stored, ok := values[id]
+	return stored, ok
+}
+
+// SaveAll saves the sessions GetMulti returned for r with SaveMulti. Once
+// the batch has been saved, it writes again the sessions changed since.
+func (s *SentinelFailoverStore) SaveAll(r *http.Request, w http.ResponseWriter) error {
+	batch, _ := r.Context().Value(batchContextKey{}).(*saveBatch)
+	if batch == nil {
+		return nil
+	}
+	return batch.save(s, r, w, nil)
+}
+
+// SaveMulti saves several sessions, writing their keys in one pipeline.
+// Deleted sessions, i.e. with a negative MaxAge, and chunked ones are
+// written on their own. Errors of single sessions are joined.
+func (s *SentinelFailoverStore) SaveMulti(r *http.Request, w http.ResponseWriter, list ...*sessions.Session) error {
+	if !s.Ready() {
+		if s.failoverOption.NotReadyPolicy == NotReadyDegraded {
+			return nil
+		}
+		return ErrNotReady
+	}
+	if err := s.begin(); err != nil {
+		return err
+	}
+	defer s.end()
+
+	type pending struct {
+		session *sessions.Session
+		created bool
+		encoded encodedSession
+		cmd     *redis.StatusCmd
+	}
+	ctx := r.Context()
+	var errs []error
+	var batch []*pending
+	for _, session := range list {
+		if session.Options.MaxAge < 0 {
+			errs = append(errs, s.saveOne(r, w, session))
+			continue
+		}
+		created, err := s.prepareSave(r, session)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		e, err := s.encode(ctx, session)
+		if err != nil {
+			if created {
+				session.ID = ""
+			}
+			errs = append(errs, err)
+			continue
+		}
+		batch = append(batch, &pending{session: session, created: created, encoded: e})
+	}
+
+	pipe := s.FailoverClient.Pipeline()
+	defer pipe.Close()
+	queued := false
+	for _, p := range batch {
+		if !p.encoded.chunked {
+			p.cmd = pipe.Set(s.sessionKey(p.session.ID), p.encoded.data, p.encoded.ttl)
+			queued = true
+		}
+	}
+	if queued {
+		start := time.Now()
+		// Errors are read from the commands below.
+		pipe.Exec()
+		s.metrics.Redis(OpSave, time.Since(start))
+	}
+
+	for _, p := range batch {
+		var err error
+		if p.encoded.chunked {
+			start := time.Now()
+			err = s.writeChunks(p.session.ID, p.encoded.data, p.encoded.ttl)
+			s.metrics.Redis(OpSave, time.Since(start))
+		} else {
+			err = p.cmd.Err()
+		}
+		if err = s.written(ctx, p.session, p.encoded, err); err == nil {
+			err = s.finishSave(r, w, p.session, p.created)
+		}
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
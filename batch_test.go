@@ -0,0 +1,81 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package redisbackendhttpsessionstore
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/boj/redistore"
+	"github.com/gorilla/sessions"
+)
+
+func TestBatchWritesSessionsChangedAfterFlush(t *testing.T) {
+	s := &SentinelFailoverStore{serializer: redistore.GobSerializer{}}
+	tests := []struct {
+		name    string
+		change  func(session *sessions.Session)
+		changed bool
+	}{
+		{"untouched", func(*sessions.Session) {}, false},
+		{"value set again", func(session *sessions.Session) { session.Values["user"] = "ada" }, false},
+		{"value edited", func(session *sessions.Session) { session.Values["user"] = "bob" }, true},
+		{"value added", func(session *sessions.Session) { session.Values["theme"] = "dark" }, true},
+		{"value removed", func(session *sessions.Session) { delete(session.Values, "user") }, true},
+		{"slice edited in place", func(session *sessions.Session) { session.Values["cart"].([]string)[0] = "pear" }, true},
+		{"logout", func(session *sessions.Session) { session.Options.MaxAge = -1 }, true},
+		{"new ID", func(session *sessions.Session) { session.ID = "other" }, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := sessions.NewSession(s, "cart")
+			session.ID = "id"
+			session.Options = &sessions.Options{Path: "/", MaxAge: 3600}
+			session.Values["user"] = "ada"
+			session.Values["cart"] = []string{"apple"}
+			for i := 0; i < 20; i++ {
+				// Enough keys for the serialized map order to vary.
+				session.Values["k"+strconv.Itoa(i)] = i
+			}
+			batch := &saveBatch{
+				sessions: []*sessions.Session{session},
+				flushed:  make(map[*sessions.Session]flushedSession),
+			}
+			batch.record(s, session)
+
+			tt.change(session)
+			if got := batch.changed(s, session); got != tt.changed {
+				t.Fatalf("changed() after the first save = %v, want %v", got, tt.changed)
+			}
+			// The second save writes the session and records it.
+			batch.record(s, session)
+			if batch.changed(s, session) {
+				t.Fatal("changed() after the second save = true, want false")
+			}
+		})
+	}
+}
+
+func TestBatchWritesSessionsOfAFailedFlush(t *testing.T) {
+	s := &SentinelFailoverStore{serializer: redistore.GobSerializer{}}
+	session := sessions.NewSession(s, "cart")
+	session.ID = "id"
+	batch := &saveBatch{
+		sessions: []*sessions.Session{session},
+		flushed:  make(map[*sessions.Session]flushedSession),
+	}
+	if !batch.changed(s, session) {
+		t.Fatal("changed() of a session never written = false, want true")
+	}
+}
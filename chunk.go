@@ -0,0 +1,157 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package redisbackendhttpsessionstore
+
+import (
+	"bytes"
+	"strconv"
+	"time"
+
+	"gopkg.in/redis.v3"
+)
+
+// ChunkConfig configures chunked storage of big sessions.
+type ChunkConfig struct {
+	// ChunkSize is the size of each chunk, by default the maximum length
+	// of the store.
+	ChunkSize int
+	// MaxSize bounds the whole session, 1 MiB by default. Bigger sessions
+	// still fail to save.
+	MaxSize int
+}
+
+// chunkMagic starts the manifest stored in the session key of a chunked
+// session, followed by the number of chunks. Neither gob nor JSON output
+// starts with a zero byte.
+const chunkMagic = "\x00chunked:"
+
+// EnableChunking makes sessions over the maximum length be split across
+// several keys instead of failing to save. The chunks are written in one
+// script with the TTL of the session, which also deletes the chunks a
+// previous, bigger version left, and reassembled on load.
+//
+// Chunks of a session that later shrinks below the maximum length are not
+// deleted, they expire with their TTL.
+func (s *SentinelFailoverStore) EnableChunking(config ChunkConfig) {
+	if config.ChunkSize <= 0 {
+		config.ChunkSize = s.maxLength
+	}
+	if config.ChunkSize <= 0 {
+		config.ChunkSize = 4096
+	}
+	if config.MaxSize <= 0 {
+		config.MaxSize = 1 << 20
+	}
+	s.chunking = &config
+}
+
+// writeChunksScript stores the chunks in ARGV[3..] under the chunk key
+// prefix ARGV[1] with the TTL ARGV[2] in milliseconds, 0 for none, writes
+// the manifest to the session key KEYS[1] and deletes the chunks of the
+// previous manifest past the new count.
+const writeChunksScript = `
+local function set(key, value)
+	if tonumber(ARGV[2]) > 0 then
+		redis.call('SET', key, value, 'PX', ARGV[2])
+	else
+		redis.call('SET', key, value)
+	end
+end
+local head = redis.call('GETRANGE', KEYS[1], 0, 31)
+local n = #ARGV - 2
+for i = 0, n - 1 do
+	set(ARGV[1] .. i, ARGV[i + 3])
+end
+if string.sub(head, 1, 9) == '\0chunked:' then
+	for i = n, (tonumber(string.sub(head, 10)) or 0) - 1 do
+		redis.call('DEL', ARGV[1] .. i)
+	end
+end
+set(KEYS[1], '\0chunked:' .. n)
+return n`
+
+// readChunksScript returns the session key KEYS[1], reassembled from the
+// chunks under the chunk key prefix ARGV[1] if it holds a manifest, so the
+// manifest and chunks are read from the same write. A missing chunk
+// returns nil.
+const readChunksScript = `
+local v = redis.call('GET', KEYS[1])
+if not v or string.sub(v, 1, 9) ~= '\0chunked:' then
+	return v
+end
+local chunks = {}
+for i = 0, (tonumber(string.sub(v, 10)) or 0) - 1 do
+	local chunk = redis.call('GET', ARGV[1] .. i)
+	if not chunk then
+		return false
+	end
+	chunks[#chunks + 1] = chunk
+end
+return table.concat(chunks)`
+
+// writeChunks stores data in chunks and the manifest in the session key.
+func (s *SentinelFailoverStore) writeChunks(id string, data []byte, ttl time.Duration) error {
+	size := s.chunking.ChunkSize
+	n := (len(data) + size - 1) / size
+	sid := s.storageID(id)
+	args := []string{s.chunkKey(sid, -1), strconv.FormatInt(int64(ttl/time.Millisecond), 10)}
+	for i := 0; i < n; i++ {
+		end := (i + 1) * size
+		if end > len(data) {
+			end = len(data)
+		}
+		args = append(args, string(data[i*size:end]))
+	}
+	err := s.FailoverClient.Eval(writeChunksScript, []string{s.storageKey(sid)}, args).Err()
+	if err == nil {
+		s.metrics.Chunked(len(data), n)
+	}
+	return err
+}
+
+// chunkCount returns the number of chunks if data is a manifest.
+func chunkCount(data []byte) (int, bool) {
+	if !bytes.HasPrefix(data, []byte(chunkMagic)) {
+		return 0, false
+	}
+	n, err := strconv.Atoi(string(data[len(chunkMagic):]))
+	return n, err == nil && n > 0
+}
+
+// readChunks reads a chunked session again, together with its chunks. A
+// missing chunk makes the whole session missing, i.e. redis.Nil.
+func (s *SentinelFailoverStore) readChunks(id string) ([]byte, error) {
+	sid := s.storageID(id)
+	v, err := s.FailoverClient.Eval(readChunksScript, []string{s.storageKey(sid)},
+		[]string{s.chunkKey(sid, -1)}).Result()
+	if err != nil {
+		return nil, err
+	}
+	data, ok := v.(string)
+	if !ok {
+		return nil, redis.Nil
+	}
+	return []byte(data), nil
+}
+
+// chunkKey returns the key of a chunk of the session with storage ID sid,
+// outside the session prefix. A negative i returns the prefix of the chunk
+// keys, for scripts.
+func (s *SentinelFailoverStore) chunkKey(sid string, i int) string {
+	prefix := "chunk_" + s.keyPrefix + sid + "_"
+	if i < 0 {
+		return prefix
+	}
+	return prefix + strconv.Itoa(i)
+}
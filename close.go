@@ -0,0 +1,129 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package redisbackendhttpsessionstore
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrStoreClosed is returned by Save once Close has been called.
+var ErrStoreClosed = errors.New("SessionStore: store is closed")
+
+// lifecycle tracks in-flight writes and background goroutines so Close
+// can wait for them.
+type lifecycle struct {
+	mu         sync.RWMutex
+	closed     bool
+	done       chan struct{}
+	closers    []func() error
+	inflight   sync.WaitGroup
+	background sync.WaitGroup
+}
+
+// begin registers an in-flight write, it fails once the store is closed.
+func (s *SentinelFailoverStore) begin() error {
+	s.life.mu.RLock()
+	defer s.life.mu.RUnlock()
+	if s.life.closed {
+		return ErrStoreClosed
+	}
+	s.life.inflight.Add(1)
+	return nil
+}
+
+func (s *SentinelFailoverStore) end() {
+	s.life.inflight.Done()
+}
+
+// goBackground runs fn in a goroutine that Close waits for. fn must return
+// soon after done is closed.
+func (s *SentinelFailoverStore) goBackground(fn func(done <-chan struct{})) {
+	s.life.mu.Lock()
+	defer s.life.mu.Unlock()
+	if s.life.closed {
+		return
+	}
+	s.life.background.Add(1)
+	go func() {
+		defer s.life.background.Done()
+		fn(s.life.done)
+	}()
+}
+
+// onClose registers f to run when the store closes, before waiting for
+// background goroutines. It is used to unblock goroutines sitting in a
+// blocking read, e.g. a subscription.
+func (s *SentinelFailoverStore) onClose(f func() error) {
+	s.life.mu.Lock()
+	defer s.life.mu.Unlock()
+	s.life.closers = append(s.life.closers, f)
+}
+
+// Close stops accepting writes, waits for in-flight saves and background
+// goroutines, then closes all Redis connections, including the pool of the
+// embedded RediStore if one was set. If ctx is done first, the connections
+// are closed anyway and ctx.Err() is returned.
+//
+// It replaces RediStore.Close. Calling Close more than once is a no-op.
+func (s *SentinelFailoverStore) Close(ctx context.Context) error {
+	s.life.mu.Lock()
+	if s.life.closed {
+		s.life.mu.Unlock()
+		return nil
+	}
+	s.life.closed = true
+	close(s.life.done)
+	closers := s.life.closers
+	s.life.mu.Unlock()
+
+	errInflight := wait(ctx, &s.life.inflight)
+	var errs []error
+	for _, f := range closers {
+		if err := f(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	errBackground := wait(ctx, &s.life.background)
+	if err := s.FailoverClient.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	if s.RediStore.Pool != nil {
+		if err := s.RediStore.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if errInflight != nil {
+		errs = append(errs, errInflight)
+	} else if errBackground != nil {
+		errs = append(errs, errBackground)
+	}
+	return errors.Join(errs...)
+}
+
+// wait returns when wg is done or ctx is done, whichever comes first.
+func wait(ctx context.Context, wg *sync.WaitGroup) error {
+	c := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(c)
+	}()
+	select {
+	case <-c:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
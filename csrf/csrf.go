@@ -0,0 +1,235 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package csrf protects forms against cross-site request forgery with a
+// secret kept in the server-side session. Since the secret lives in the
+// session, e.g. in a SentinelFailoverStore, tokens stay valid when the
+// next request reaches another instance or Redis failed over.
+//
+// Every token handed out is the secret masked with a fresh one-time pad,
+// so it differs on every page (which defeats BREACH) while any of them
+// validates.
+//
+//	protector := csrf.New(store, csrf.Options{SessionName: "session-name"})
+//	http.Handle("/signin/", protector.Middleware(signin))
+//
+// and in the form template
+//
+//	<form method="POST">{{csrfField .Request}} ... </form>
+package csrf
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"html/template"
+	"net/http"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	redisbackendhttpsessionstore "github.com/stackdocker/http-session-redis-sentinel-backend"
+)
+
+const tokenLength = 32
+
+// secretKey is the session value holding the secret.
+const secretKey = "_csrf_secret"
+
+var (
+	// ErrNoSecret is returned when the session holds no secret, typically
+	// because it expired since the form was rendered.
+	ErrNoSecret = errors.New("csrf: no secret in session")
+	// ErrBadToken is returned when the token is missing or does not match.
+	ErrBadToken = errors.New("csrf: token missing or invalid")
+)
+
+// Options configures a Protector.
+type Options struct {
+	// SessionName is the name of the session holding the secret.
+	SessionName string
+	// FieldName is the form field carrying the token, "csrf_token" by
+	// default.
+	FieldName string
+	// HeaderName is the request header carrying the token for scripts,
+	// "X-CSRF-Token" by default.
+	HeaderName string
+	// ErrorHandler serves rejected requests, by default a plain 403.
+	// Requests whose session cannot be read get a 500 instead.
+	ErrorHandler http.Handler
+}
+
+// Protector issues and validates tokens.
+type Protector struct {
+	store sessions.Store
+	opts  Options
+}
+
+// New returns a protector keeping its secret in the named session of store.
+func New(store sessions.Store, opts Options) *Protector {
+	if opts.FieldName == "" {
+		opts.FieldName = "csrf_token"
+	}
+	if opts.HeaderName == "" {
+		opts.HeaderName = "X-CSRF-Token"
+	}
+	if opts.ErrorHandler == nil {
+		opts.ErrorHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		})
+	}
+	return &Protector{store: store, opts: opts}
+}
+
+// session returns the session holding the secret. A bad cookie or a
+// session refused by a validator is not an error here: the store returns
+// a usable session, a fresh one has no secret and fails the token check.
+// Other store errors are returned.
+func (p *Protector) session(r *http.Request) (*sessions.Session, error) {
+	session, err := p.store.Get(r, p.opts.SessionName)
+	var verr *redisbackendhttpsessionstore.ValidationError
+	if err != nil && !redisbackendhttpsessionstore.IsCookieError(err) && !errors.As(err, &verr) {
+		return nil, err
+	}
+	if session == nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// secret returns the secret of session, creating it if create is set.
+// A created secret is only kept once the session is saved.
+func secret(session *sessions.Session, create bool) []byte {
+	if s, ok := session.Values[secretKey].([]byte); ok && len(s) == tokenLength {
+		return s
+	}
+	if !create {
+		return nil
+	}
+	s := securecookie.GenerateRandomKey(tokenLength)
+	session.Values[secretKey] = s
+	return s
+}
+
+// Token returns a masked token for the session of r. If the session holds
+// no secret yet one is created, and the caller must save the session;
+// Middleware takes care of that for pages it serves.
+func (p *Protector) Token(r *http.Request) (string, error) {
+	session, err := p.session(r)
+	if err != nil {
+		return "", err
+	}
+	return mask(secret(session, true)), nil
+}
+
+// TemplateField returns a hidden input carrying a token, for use in form
+// templates. It renders nothing if the session cannot be read.
+func (p *Protector) TemplateField(r *http.Request) template.HTML {
+	token, err := p.Token(r)
+	if err != nil {
+		return ""
+	}
+	return template.HTML(`<input type="hidden" name="` +
+		template.HTMLEscapeString(p.opts.FieldName) + `" value="` + token + `"/>`)
+}
+
+// FuncMap returns the template helpers csrfField and csrfToken, both taking
+// the request.
+func (p *Protector) FuncMap() template.FuncMap {
+	return template.FuncMap{
+		"csrfField": p.TemplateField,
+		"csrfToken": func(r *http.Request) string {
+			token, _ := p.Token(r)
+			return token
+		},
+	}
+}
+
+// Validate checks the token sent with r against the session secret. It
+// returns ErrNoSecret or ErrBadToken for a rejected token, and the store
+// error when the session cannot be read.
+func (p *Protector) Validate(r *http.Request) error {
+	session, err := p.session(r)
+	if err != nil {
+		return err
+	}
+	s := secret(session, false)
+	if s == nil {
+		return ErrNoSecret
+	}
+	token := r.Header.Get(p.opts.HeaderName)
+	if token == "" {
+		token = r.PostFormValue(p.opts.FieldName)
+	}
+	if !equal(unmask(token), s) {
+		return ErrBadToken
+	}
+	return nil
+}
+
+// Middleware makes sure safe requests leave with a secret in the session,
+// and rejects unsafe requests without a valid token.
+func (p *Protector) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET", "HEAD", "OPTIONS", "TRACE":
+			session, err := p.session(r)
+			if err != nil {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			if secret(session, false) == nil {
+				secret(session, true)
+				// A failed save only means the next form post is
+				// rejected, the page itself can still be served.
+				session.Save(r, w)
+			}
+		default:
+			if err := p.Validate(r); err == ErrNoSecret || err == ErrBadToken {
+				p.opts.ErrorHandler.ServeHTTP(w, r)
+				return
+			} else if err != nil {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// mask returns base64(pad || pad XOR secret) with a fresh random pad.
+func mask(secret []byte) string {
+	pad := securecookie.GenerateRandomKey(tokenLength)
+	token := make([]byte, 2*tokenLength)
+	copy(token, pad)
+	for i := 0; i < tokenLength; i++ {
+		token[tokenLength+i] = pad[i] ^ secret[i]
+	}
+	return base64.RawURLEncoding.EncodeToString(token)
+}
+
+// unmask reverses mask, it returns nil for malformed tokens.
+func unmask(token string) []byte {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(raw) != 2*tokenLength {
+		return nil
+	}
+	secret := make([]byte, tokenLength)
+	for i := 0; i < tokenLength; i++ {
+		secret[i] = raw[i] ^ raw[tokenLength+i]
+	}
+	return secret
+}
+
+func equal(a, b []byte) bool {
+	return len(a) == tokenLength && subtle.ConstantTimeCompare(a, b) == 1
+}
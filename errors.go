@@ -0,0 +1,130 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package redisbackendhttpsessionstore
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gorilla/securecookie"
+)
+
+// Error kinds returned by the store. Errors carrying details wrap one of
+// them, so test with errors.Is:
+//
+//	session, err := store.Get(r, "session-name")
+//	if errors.Is(err, redisbackendhttpsessionstore.ErrBackendUnavailable) {
+//		// retry later
+//	}
+var (
+	// ErrSessionNotFound means the session key does not exist, usually
+	// because the session expired. New does not report it, it returns a
+	// fresh session instead.
+	ErrSessionNotFound = errors.New("SessionStore: session not found")
+	// ErrSessionTooLarge is matched by *SessionTooLargeError.
+	ErrSessionTooLarge = errors.New("SessionStore: the value to store is too big")
+	// ErrBackendUnavailable wraps errors talking to Redis. ErrNotReady
+	// matches it too.
+	ErrBackendUnavailable = errors.New("SessionStore: backend unavailable")
+	// ErrDecode wraps errors serializing or deserializing session values.
+	ErrDecode = errors.New("SessionStore: session could not be decoded")
+	// ErrCookieInvalid wraps errors decoding the session cookie, e.g. a
+	// tampered value or one signed with a retired key.
+	ErrCookieInvalid = errors.New("SessionStore: session cookie invalid")
+	// ErrCookieExpired is returned for a cookie whose signed timestamp is
+	// older than the MaxAge of the codecs.
+	ErrCookieExpired = errors.New("SessionStore: session cookie expired")
+	// ErrFieldValue wraps errors of atomic field operations on a value they
+	// cannot apply to, e.g. a counter that is not an integer.
+	ErrFieldValue = errors.New("SessionStore: atomic field holds an incompatible value")
+)
+
+// SessionTooLargeError is returned by Save for a session whose serialized
+// size exceeds the limit of the store.
+type SessionTooLargeError struct {
+	Size  int
+	Limit int
+}
+
+func (e *SessionTooLargeError) Error() string {
+	return fmt.Sprintf("%s (%d bytes, limit %d)", ErrSessionTooLarge, e.Size, e.Limit)
+}
+
+// Is makes errors.Is(err, ErrSessionTooLarge) hold.
+func (e *SessionTooLargeError) Is(target error) bool {
+	return target == ErrSessionTooLarge
+}
+
+// unavailableError is a sentinel error that also matches
+// ErrBackendUnavailable.
+type unavailableError string
+
+func (e unavailableError) Error() string {
+	return string(e)
+}
+
+func (e unavailableError) Is(target error) bool {
+	return target == ErrBackendUnavailable
+}
+
+func backendError(err error) error {
+	return fmt.Errorf("%w: %w", ErrBackendUnavailable, err)
+}
+
+// fieldValueError reports whether err was raised by an atomic field script
+// because of the value it found: a counter that is not an integer, a list
+// that does not decode, or a field hash of another type. Other errors, e.g.
+// OOM or READONLY during a failover, are backend errors.
+func fieldValueError(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, fieldValueReply) ||
+		strings.Contains(msg, "hash value is not an integer") ||
+		strings.Contains(msg, "WRONGTYPE")
+}
+
+func decodeError(err error) error {
+	return fmt.Errorf("%w: %w", ErrDecode, err)
+}
+
+// IsCookieError reports whether err, returned by Get or New, only means
+// that the request carried no usable session cookie, e.g. a tampered,
+// expired or malformed one. The session returned with it is a fresh one
+// and can be used. Decode errors of securecookie, as returned by other
+// gorilla stores, count too.
+func IsCookieError(err error) bool {
+	if errors.Is(err, ErrCookieInvalid) || errors.Is(err, ErrCookieExpired) {
+		return true
+	}
+	var cerr securecookie.Error
+	return errors.As(err, &cerr) && cerr.IsDecode()
+}
+
+// cookieError classifies an error of securecookie.DecodeMulti. securecookie
+// does not export its expired timestamp error, so it is recognized by its
+// message.
+func cookieError(err error) error {
+	kind := ErrCookieInvalid
+	errs := []error{err}
+	if multi, ok := err.(securecookie.MultiError); ok {
+		errs = multi
+	}
+	for _, e := range errs {
+		if e != nil && strings.Contains(e.Error(), "expired timestamp") {
+			kind = ErrCookieExpired
+			break
+		}
+	}
+	return fmt.Errorf("%w: %w", kind, err)
+}
@@ -0,0 +1,254 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package redisbackendhttpsessionstore
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"gopkg.in/redis.v3"
+)
+
+// ExpireFunc is called with the ID of a session whose key expired in Redis,
+// hashed if HashSessionKeys is in effect.
+// shadow is the payload recorded by ExpirationConfig.Shadow when the
+// session was last saved, or nil.
+type ExpireFunc func(id string, shadow []byte)
+
+// ExpirationConfig configures the expiration listener.
+type ExpirationConfig struct {
+	// ConfigureNotifications lets the listener enable expired key events
+	// with CONFIG SET notify-keyspace-events when they are off. Leave it
+	// false where CONFIG is disabled and configure Redis by hand ("Ex").
+	ConfigureNotifications bool
+
+	// Shadow, if set, returns a minimal payload saved under a shadow key
+	// that outlives the session key by ShadowGrace, since the session data
+	// itself is gone when the event arrives. Returning nil skips it.
+	Shadow func(session *sessions.Session) []byte
+
+	// ShadowGrace defaults to 5 minutes.
+	ShadowGrace time.Duration
+}
+
+// Delay before resubscribing after the subscription failed.
+var expirationRetry = time.Second
+
+// How long an instance holds the claim on an expired key.
+var expirationClaimTTL = time.Minute
+
+// expirationListener is the state of the expiration listener.
+type expirationListener struct {
+	mu        sync.Mutex
+	config    *ExpirationConfig
+	callbacks []ExpireFunc
+	pubsub    *redis.PubSub
+}
+
+// claimExpiredScript claims an expired key for one instance and hands it
+// the shadow payload, reading and deleting the shadow key in the same step.
+// It returns nil when another instance has the claim, otherwise a list
+// holding the payload, empty if nothing was recorded.
+//
+// KEYS[1] is the claim key, KEYS[2] the shadow key. ARGV[1] is the claim
+// TTL in milliseconds.
+const claimExpiredScript = `
+if not redis.call('SET', KEYS[1], '1', 'NX', 'PX', ARGV[1]) then
+	return false
+end
+local v = redis.call('GET', KEYS[2])
+if not v then
+	return {}
+end
+redis.call('DEL', KEYS[2])
+return {v}`
+
+// OnExpire registers fn to be called when a session key expires. Callbacks
+// only run once ListenExpirations has been called.
+func (s *SentinelFailoverStore) OnExpire(fn ExpireFunc) {
+	s.expiration.mu.Lock()
+	defer s.expiration.mu.Unlock()
+	s.expiration.callbacks = append(s.expiration.callbacks, fn)
+}
+
+// ListenExpirations subscribes to the expired key events of the session
+// database and calls the OnExpire callbacks for keys under the session
+// prefix. The subscription follows failovers and is stopped by Close.
+//
+// When several instances listen, each event is delivered to a single one of
+// them, the one that takes a short lived claim key, together with the
+// shadow payload if one was recorded.
+func (s *SentinelFailoverStore) ListenExpirations(config ExpirationConfig) {
+	if config.ShadowGrace == 0 {
+		config.ShadowGrace = 5 * time.Minute
+	}
+	s.expiration.mu.Lock()
+	if s.expiration.config != nil {
+		s.expiration.mu.Unlock()
+		return
+	}
+	s.expiration.config = &config
+	s.expiration.mu.Unlock()
+
+	s.onClose(func() error {
+		s.expiration.mu.Lock()
+		defer s.expiration.mu.Unlock()
+		if s.expiration.pubsub != nil {
+			return s.expiration.pubsub.Close()
+		}
+		return nil
+	})
+	s.goBackground(s.listenExpirations)
+}
+
+func (s *SentinelFailoverStore) listenExpirations(done <-chan struct{}) {
+	config := s.expirationConfig()
+	channel := fmt.Sprintf("__keyevent@%d__:expired", s.failoverOption.DB)
+	for {
+		if config.ConfigureNotifications {
+			if err := s.enableExpiredEvents(); err != nil {
+				s.logger.Log(context.Background(), slog.LevelWarn,
+					"expired key events could not be enabled", "error", err)
+			}
+		}
+		pubsub, err := s.FailoverClient.Subscribe(channel)
+		if err == nil {
+			s.expiration.mu.Lock()
+			select {
+			case <-done:
+				// Close ran while subscribing and found no subscription
+				// to close.
+				s.expiration.mu.Unlock()
+				pubsub.Close()
+				return
+			default:
+			}
+			s.expiration.pubsub = pubsub
+			s.expiration.mu.Unlock()
+			for {
+				msg, err := pubsub.ReceiveMessage()
+				if err != nil {
+					break
+				}
+				s.expired(msg.Payload)
+			}
+			s.expiration.mu.Lock()
+			s.expiration.pubsub = nil
+			s.expiration.mu.Unlock()
+			pubsub.Close()
+		}
+		select {
+		case <-done:
+			return
+		default:
+		}
+		s.logger.Log(context.Background(), slog.LevelWarn,
+			"expiration subscription lost, resubscribing", "channel", channel, "error", err)
+		select {
+		case <-done:
+			return
+		case <-time.After(expirationRetry):
+		}
+	}
+}
+
+// enableExpiredEvents adds the "E" and "x" flags to notify-keyspace-events
+// unless they are already in effect.
+func (s *SentinelFailoverStore) enableExpiredEvents() error {
+	reply, err := s.FailoverClient.ConfigGet("notify-keyspace-events").Result()
+	if err != nil {
+		return err
+	}
+	flags := ""
+	if len(reply) == 2 {
+		flags, _ = reply[1].(string)
+	}
+	want := flags
+	if !strings.Contains(want, "E") {
+		want += "E"
+	}
+	if !strings.ContainsAny(want, "xA") {
+		want += "x"
+	}
+	if want == flags {
+		return nil
+	}
+	return s.FailoverClient.ConfigSet("notify-keyspace-events", want).Err()
+}
+
+// expired handles one expired key event.
+func (s *SentinelFailoverStore) expired(key string) {
+	if !strings.HasPrefix(key, s.keyPrefix) {
+		return
+	}
+	id := strings.TrimPrefix(key, s.keyPrefix)
+
+	// The shadow key may be missing even with Shadow set, when the
+	// session's Shadow func returned nil, so the claim does not rely on it.
+	v, err := s.FailoverClient.Eval(claimExpiredScript, []string{"expired_" + key, s.shadowKey(id)},
+		[]string{strconv.FormatInt(int64(expirationClaimTTL/time.Millisecond), 10)}).Result()
+	if err == redis.Nil {
+		// Claimed by another instance.
+		return
+	}
+	if err != nil {
+		s.logError(context.Background(), "expire", id, "expired key could not be claimed", err)
+		return
+	}
+	var shadow []byte
+	if list, ok := v.([]interface{}); ok && len(list) == 1 {
+		if str, ok := list[0].(string); ok {
+			shadow = []byte(str)
+		}
+	}
+
+	s.expiration.mu.Lock()
+	callbacks := s.expiration.callbacks
+	s.expiration.mu.Unlock()
+	for _, fn := range callbacks {
+		fn(id, shadow)
+	}
+}
+
+func (s *SentinelFailoverStore) expirationConfig() *ExpirationConfig {
+	s.expiration.mu.Lock()
+	defer s.expiration.mu.Unlock()
+	return s.expiration.config
+}
+
+// shadowKey is kept outside the session prefix so its own expiry is not
+// mistaken for a session. It takes the storage ID, see HashSessionKeys.
+func (s *SentinelFailoverStore) shadowKey(sid string) string {
+	return "shadow_" + s.keyPrefix + sid
+}
+
+// saveShadow records the shadow payload of session if the listener asks
+// for one.
+func (s *SentinelFailoverStore) saveShadow(session *sessions.Session, ttl time.Duration) error {
+	config := s.expirationConfig()
+	if config == nil || config.Shadow == nil {
+		return nil
+	}
+	payload := config.Shadow(session)
+	if payload == nil {
+		return nil
+	}
+	return s.FailoverClient.Set(s.shadowKey(s.storageID(session.ID)), payload, ttl+config.ShadowGrace).Err()
+}
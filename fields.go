@@ -0,0 +1,302 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package redisbackendhttpsessionstore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"gopkg.in/redis.v3"
+)
+
+// FieldKind is the type of an atomic session field.
+type FieldKind int
+
+const (
+	// CounterField holds an int64, changed with Incr.
+	CounterField FieldKind = iota
+	// StringField holds a string, set once with SetIfAbsent.
+	StringField
+	// ListField holds a []string, grown with Append.
+	ListField
+)
+
+func (k FieldKind) String() string {
+	switch k {
+	case CounterField:
+		return "counter"
+	case StringField:
+		return "string"
+	case ListField:
+		return "list"
+	}
+	return "FieldKind(" + strconv.Itoa(int(k)) + ")"
+}
+
+// fieldScript wraps the body of an atomic field operation. The session key
+// KEYS[1] must exist, the operation applies to the field hash KEYS[2],
+// which then gets the TTL of the session. The body sets result.
+func fieldScript(body string) string {
+	return `
+local ttl = redis.call('PTTL', KEYS[1])
+if ttl == -2 then
+	return false
+end
+local result` + body + `
+if ttl > 0 then
+	redis.call('PEXPIRE', KEYS[2], ttl)
+else
+	redis.call('PERSIST', KEYS[2])
+end
+return result`
+}
+
+// fieldValueReply starts the errors the field scripts raise themselves.
+const fieldValueReply = "FIELD_VALUE"
+
+// ARGV[1] is the field, ARGV[2] the operand.
+var (
+	incrScript = fieldScript(`
+result = redis.call('HINCRBY', KEYS[2], ARGV[1], ARGV[2])`)
+	setIfAbsentScript = fieldScript(`
+result = redis.call('HSETNX', KEYS[2], ARGV[1], ARGV[2])`)
+	appendScript = fieldScript(`
+local list = {}
+local raw = redis.call('HGET', KEYS[2], ARGV[1])
+if raw then
+	local ok, decoded = pcall(cjson.decode, raw)
+	if not ok or type(decoded) ~= 'table' then
+		return redis.error_reply('` + fieldValueReply + ` not a list')
+	end
+	list = decoded
+end
+table.insert(list, ARGV[2])
+redis.call('HSET', KEYS[2], ARGV[1], cjson.encode(list))
+result = #list`)
+	deleteFieldScript = fieldScript(`
+result = redis.call('HDEL', KEYS[2], ARGV[1])`)
+)
+
+// SetAtomicFields declares the session fields stored apart from the rest of
+// the session, in a Redis hash per session, so they can be changed in
+// place by the operations of SessionFields without a load and save cycle
+// racing with parallel requests.
+//
+// Declared fields still show up in session.Values when the session is
+// loaded, with the Go type of their kind, but they are read-only there:
+// Save leaves them out of the serialized session and never writes them.
+// The field hash expires with the session. Call it before serving
+// requests.
+func (s *SentinelFailoverStore) SetAtomicFields(fields map[string]FieldKind) {
+	s.atomicFields = fields
+}
+
+// SessionFields applies atomic operations to the declared fields of one
+// session. Every operation is a single Lua script, fails with
+// ErrSessionNotFound when the session key does not exist, with
+// ErrFieldValue when the field holds a value the operation cannot apply
+// to, and leaves the field hash with the TTL of the session.
+type SessionFields struct {
+	store *SentinelFailoverStore
+	id    string
+}
+
+// Fields returns the atomic fields of the session with the given ID.
+func (s *SentinelFailoverStore) Fields(id string) *SessionFields {
+	return &SessionFields{store: s, id: id}
+}
+
+// RequestFields returns the atomic fields of the named session of r. The
+// session ID is read from the request, the session is not loaded, so a
+// session already loaded for r keeps the values it was loaded with.
+func (s *SentinelFailoverStore) RequestFields(r *http.Request, name string) *SessionFields {
+	return s.Fields(s.Lazy(r, name).ID())
+}
+
+// Incr adds delta to a counter field, missing fields count as zero, and
+// returns the new value.
+func (f *SessionFields) Incr(field string, delta int64) (int64, error) {
+	return f.run(incrScript, field, CounterField, strconv.FormatInt(delta, 10))
+}
+
+// SetIfAbsent sets a string field unless it is already set, and reports
+// whether it did.
+func (f *SessionFields) SetIfAbsent(field, value string) (bool, error) {
+	n, err := f.run(setIfAbsentScript, field, StringField, value)
+	return n == 1, err
+}
+
+// Append adds value to the end of a list field and returns the new length.
+func (f *SessionFields) Append(field, value string) (int, error) {
+	n, err := f.run(appendScript, field, ListField, value)
+	return int(n), err
+}
+
+// Delete removes a field of any kind, and reports whether it was set.
+func (f *SessionFields) Delete(field string) (bool, error) {
+	kind, ok := f.store.atomicFields[field]
+	if !ok {
+		return false, fmt.Errorf("SessionStore: field %q is not an atomic field", field)
+	}
+	n, err := f.run(deleteFieldScript, field, kind, "")
+	return n == 1, err
+}
+
+func (f *SessionFields) run(script, field string, kind FieldKind, arg string) (int64, error) {
+	s := f.store
+	if declared, ok := s.atomicFields[field]; !ok || declared != kind {
+		return 0, fmt.Errorf("SessionStore: field %q is not a %s field", field, kind)
+	}
+	if f.id == "" {
+		return 0, ErrSessionNotFound
+	}
+	if !s.Ready() {
+		return 0, ErrNotReady
+	}
+	sid := s.storageID(f.id)
+	start := time.Now()
+	var v interface{}
+	var err error
+	if s.migrating() {
+		// The script below only sees hashed keys.
+		_, err = s.migrateKey(context.Background(), f.id)
+	}
+	if err == nil {
+		v, err = s.FailoverClient.Eval(script, []string{s.storageKey(sid), s.fieldsKey(sid)},
+			[]string{field, arg}).Result()
+	}
+	s.metrics.Redis(OpSave, time.Since(start))
+	if err == redis.Nil {
+		return 0, ErrSessionNotFound
+	}
+	if err != nil && fieldValueError(err) {
+		s.metrics.Error(OpSave, ErrKindField)
+		s.logError(context.Background(), OpSave, f.id, "session field could not be updated", err,
+			"field", field)
+		return 0, fmt.Errorf("%w: %w", ErrFieldValue, err)
+	}
+	if err != nil {
+		s.metrics.Error(OpSave, ErrKindRedis)
+		s.logError(context.Background(), OpSave, f.id, "session field could not be updated", err,
+			"field", field)
+		return 0, backendError(err)
+	}
+	n, _ := v.(int64)
+	return n, nil
+}
+
+// storedSession is what Redis holds for a session: the content of the
+// session key and the field hash.
+type storedSession struct {
+	data   []byte
+	fields map[string]string
+}
+
+// readStored reads the session key of id and, with atomic fields declared,
+// its field hash in the same round trip.
+func (s *SentinelFailoverStore) readStored(id string) (storedSession, error) {
+	sid := s.storageID(id)
+	if len(s.atomicFields) == 0 {
+		data, err := s.FailoverClient.Get(s.storageKey(sid)).Bytes()
+		return storedSession{data: data}, err
+	}
+	pipe := s.FailoverClient.Pipeline()
+	defer pipe.Close()
+	get := pipe.Get(s.storageKey(sid))
+	hash := pipe.HGetAllMap(s.fieldsKey(sid))
+	// Errors are read from the commands below.
+	pipe.Exec()
+	data, err := get.Bytes()
+	if err != nil {
+		return storedSession{}, err
+	}
+	fields, err := hash.Result()
+	return storedSession{data: data, fields: fields}, err
+}
+
+// loadFields replaces the declared fields in session.Values with the
+// content of the field hash.
+func (s *SentinelFailoverStore) loadFields(ctx context.Context, session *sessions.Session, values map[string]string) error {
+	var err error
+	for field, kind := range s.atomicFields {
+		delete(session.Values, field)
+		raw, ok := values[field]
+		if !ok {
+			continue
+		}
+		var value interface{}
+		switch kind {
+		case CounterField:
+			value, err = strconv.ParseInt(raw, 10, 64)
+		case ListField:
+			var list []string
+			err = json.Unmarshal([]byte(raw), &list)
+			value = list
+		default:
+			value = raw
+		}
+		if err != nil {
+			s.metrics.Error(OpLoad, ErrKindDeserialize)
+			s.logError(ctx, OpLoad, session.ID, "session field could not be decoded", err,
+				"field", field)
+			return decodeError(err)
+		}
+		session.Values[field] = value
+	}
+	return nil
+}
+
+// withoutFields returns session, or a copy of it without the declared
+// fields if it holds any, for serialization.
+func (s *SentinelFailoverStore) withoutFields(session *sessions.Session) *sessions.Session {
+	found := false
+	for field := range s.atomicFields {
+		if _, found = session.Values[field]; found {
+			break
+		}
+	}
+	if !found {
+		return session
+	}
+	stripped := *session
+	stripped.Values = make(map[interface{}]interface{}, len(session.Values))
+	for k, v := range session.Values {
+		if field, ok := k.(string); ok {
+			if _, ok = s.atomicFields[field]; ok {
+				continue
+			}
+		}
+		stripped.Values[k] = v
+	}
+	return &stripped
+}
+
+// expireFields gives the field hash of a saved session its TTL.
+func (s *SentinelFailoverStore) expireFields(id string, ttl time.Duration) error {
+	if len(s.atomicFields) == 0 {
+		return nil
+	}
+	return s.FailoverClient.PExpire(s.fieldsKey(s.storageID(id)), ttl).Err()
+}
+
+// fieldsKey returns the key of the field hash of a session, outside the
+// session prefix. It takes the storage ID, see HashSessionKeys.
+func (s *SentinelFailoverStore) fieldsKey(sid string) string {
+	return "fields_" + s.keyPrefix + sid
+}
@@ -0,0 +1,237 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package redisbackendhttpsessionstore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/sessions"
+)
+
+// TrustedProxies lists the networks of reverse proxies whose forwarding
+// headers are believed when determining the client IP.
+type TrustedProxies []*net.IPNet
+
+// ParseTrustedProxies parses CIDRs such as "10.0.0.0/8". A bare IP is
+// taken as a single host.
+func ParseTrustedProxies(cidrs ...string) (TrustedProxies, error) {
+	proxies := make(TrustedProxies, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+func (t TrustedProxies) trusted(ip net.IP) bool {
+	for _, network := range t {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the IP of the client that sent r. Forwarding headers are
+// only used when the peer is a trusted proxy: X-Forwarded-For is walked from
+// the right, skipping trusted proxies, then X-Real-IP is consulted.
+func (t TrustedProxies) ClientIP(r *http.Request) net.IP {
+	ip := net.ParseIP(remoteIP(r))
+	if ip == nil || !t.trusted(ip) {
+		return ip
+	}
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		hops := strings.Split(strings.Join(xff, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := net.ParseIP(strings.TrimSpace(hops[i]))
+			if hop == nil {
+				break
+			}
+			ip = hop
+			if !t.trusted(hop) {
+				return ip
+			}
+		}
+		return ip
+	}
+	if xri := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); xri != nil {
+		return xri
+	}
+	return ip
+}
+
+// SetTrustedProxies sets the proxies whose forwarding headers the store
+// believes, for fingerprint binding and the audit trail.
+func (s *SentinelFailoverStore) SetTrustedProxies(proxies TrustedProxies) {
+	s.trustedProxies = proxies
+}
+
+// clientIP returns the client IP of r as a string.
+func (s *SentinelFailoverStore) clientIP(r *http.Request) string {
+	if ip := s.trustedProxies.ClientIP(r); ip != nil {
+		return ip.String()
+	}
+	return remoteIP(r)
+}
+
+// BindingStrictness decides what happens when a session is presented by a
+// client whose fingerprint does not match the one recorded.
+type BindingStrictness int
+
+const (
+	// BindingLog only reports the mismatch to the logger and metrics.
+	BindingLog BindingStrictness = iota
+	// BindingReauthenticate keeps the session but New returns a
+	// ValidationError with OutcomeReauthenticate.
+	BindingReauthenticate
+	// BindingReject deletes the session and New returns a fresh one with
+	// a ValidationError with OutcomeReject.
+	BindingReject
+)
+
+// BindingConfig chooses the request attributes bound to a session.
+type BindingConfig struct {
+	// UserAgent binds the User-Agent header.
+	UserAgent bool
+	// IPv4Prefix and IPv6Prefix bind the client IP masked to this many
+	// bits, e.g. 24 and 64. Zero leaves the address family unbound.
+	IPv4Prefix int
+	IPv6Prefix int
+	// TLSClientCert binds the hash of the TLS client certificate.
+	TLSClientCert bool
+	Strictness    BindingStrictness
+}
+
+// fingerprintKey is the session value holding the recorded fingerprint.
+const fingerprintKey = "_fingerprint"
+
+// BindSessions turns on fingerprint binding: the first Save of a session
+// records a fingerprint of the request attributes chosen in config, and
+// New compares it with the request presenting the session. Sessions saved
+// before binding was turned on are accepted and get bound on their next
+// save.
+//
+// Later saves keep the recorded fingerprint, so a stolen session cannot be
+// rebound to the thief's client by using it. Call RebindSession once the
+// user proved their identity again, e.g. after a reauthentication.
+func (s *SentinelFailoverStore) BindSessions(config BindingConfig) {
+	s.binding = &config
+	s.OnBeforeSave(func(r *http.Request, session *sessions.Session) error {
+		if _, ok := session.Values[fingerprintKey]; !ok {
+			session.Values[fingerprintKey] = s.fingerprint(r, config)
+		}
+		return nil
+	})
+	s.AddValidator(func(r *http.Request, session *sessions.Session) error {
+		recorded, ok := session.Values[fingerprintKey].(string)
+		if !ok {
+			return nil
+		}
+		mismatch := fingerprintMismatch(recorded, s.fingerprint(r, config))
+		if mismatch == "" {
+			return nil
+		}
+		s.metrics.Error(OpLoad, ErrKindFingerprint)
+		// A refused session is logged by the validator chain.
+		switch config.Strictness {
+		case BindingReject:
+			return RejectSession("fingerprint mismatch: " + mismatch)
+		case BindingReauthenticate:
+			return RequireReauthentication("fingerprint mismatch: " + mismatch)
+		}
+		s.logger.Log(r.Context(), slog.LevelWarn, "session fingerprint mismatch",
+			"op", OpLoad, "session", hashID(session.ID), "attributes", mismatch,
+			"ip", s.clientIP(r))
+		return nil
+	})
+}
+
+// RebindSession records the fingerprint of r in session, replacing the one
+// bound so far. It takes effect on the next Save and does nothing unless
+// BindSessions was called.
+func (s *SentinelFailoverStore) RebindSession(r *http.Request, session *sessions.Session) {
+	if s.binding == nil {
+		return
+	}
+	session.Values[fingerprintKey] = s.fingerprint(r, *s.binding)
+}
+
+// fingerprint returns "name=hash" components joined by ";".
+func (s *SentinelFailoverStore) fingerprint(r *http.Request, config BindingConfig) string {
+	var parts []string
+	if config.UserAgent {
+		parts = append(parts, "ua="+fingerprintHash(r.UserAgent()))
+	}
+	if config.IPv4Prefix > 0 || config.IPv6Prefix > 0 {
+		ip := s.trustedProxies.ClientIP(r)
+		var prefix string
+		if ip4 := ip.To4(); ip4 != nil && config.IPv4Prefix > 0 {
+			prefix = ip4.Mask(net.CIDRMask(config.IPv4Prefix, 32)).String()
+		} else if ip4 == nil && ip != nil && config.IPv6Prefix > 0 {
+			prefix = ip.Mask(net.CIDRMask(config.IPv6Prefix, 128)).String()
+		}
+		parts = append(parts, "ip="+fingerprintHash(prefix))
+	}
+	if config.TLSClientCert {
+		var cert []byte
+		if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+			cert = r.TLS.PeerCertificates[0].Raw
+		}
+		parts = append(parts, "cert="+fingerprintHash(string(cert)))
+	}
+	return strings.Join(parts, ";")
+}
+
+// fingerprintMismatch returns the names of the attributes that differ. An
+// attribute missing on either side is not compared, so changing the
+// binding configuration does not invalidate every session.
+func fingerprintMismatch(recorded, current string) string {
+	got := make(map[string]string)
+	for _, part := range strings.Split(current, ";") {
+		if name, value, ok := strings.Cut(part, "="); ok {
+			got[name] = value
+		}
+	}
+	var names []string
+	for _, part := range strings.Split(recorded, ";") {
+		name, value, ok := strings.Cut(part, "=")
+		if !ok {
+			continue
+		}
+		if v, ok := got[name]; ok && v != value {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+func fingerprintHash(v string) string {
+	sum := sha256.Sum256([]byte(v))
+	return hex.EncodeToString(sum[:12])
+}
@@ -0,0 +1,158 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package redisbackendhttpsessionstore
+
+import (
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	tests := []struct {
+		cidr    string
+		inside  string
+		outside string
+	}{
+		{"10.0.0.0/8", "10.255.0.1", "11.0.0.1"},
+		{"192.0.2.1", "192.0.2.1", "192.0.2.2"},
+		{"fd00::/8", "fd12::1", "fe80::1"},
+		{"2001:db8::5", "2001:db8::5", "2001:db8::6"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.cidr, func(t *testing.T) {
+			proxies, err := ParseTrustedProxies(tt.cidr)
+			if err != nil {
+				t.Fatalf("ParseTrustedProxies(%q) = %v", tt.cidr, err)
+			}
+			if !proxies.trusted(net.ParseIP(tt.inside)) {
+				t.Errorf("%s is not trusted", tt.inside)
+			}
+			if proxies.trusted(net.ParseIP(tt.outside)) {
+				t.Errorf("%s is trusted", tt.outside)
+			}
+		})
+	}
+	for _, cidr := range []string{"10.0.0.0/33", "proxy", "10.0.0.300"} {
+		if _, err := ParseTrustedProxies(cidr); err == nil {
+			t.Errorf("ParseTrustedProxies(%q) = nil error", cidr)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	proxies, err := ParseTrustedProxies("10.0.0.0/8", "fd00::/8", "192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		remote string
+		xff    []string
+		xri    string
+		want   string
+	}{
+		{"no headers", "198.51.100.7:1234", nil, "", "198.51.100.7"},
+		{"untrusted peer", "203.0.113.5:1234", []string{"198.51.100.7"}, "198.51.100.8", "203.0.113.5"},
+		{"trusted peer", "10.0.0.1:1234", []string{"198.51.100.7"}, "", "198.51.100.7"},
+		{"trusted bare host", "192.0.2.1:80", []string{"198.51.100.7"}, "", "198.51.100.7"},
+		{"untrusted neighbour of bare host", "192.0.2.2:80", []string{"198.51.100.7"}, "", "192.0.2.2"},
+		{"trusted hops skipped", "10.0.0.1:1234", []string{"198.51.100.7, 10.1.1.1, 10.2.2.2"}, "", "198.51.100.7"},
+		{"spoofed hops left of the client", "10.0.0.1:1234", []string{"6.6.6.6, 198.51.100.7, 10.1.1.1"}, "", "198.51.100.7"},
+		{"several headers", "10.0.0.1:1234", []string{"6.6.6.6", "198.51.100.7"}, "", "198.51.100.7"},
+		{"only trusted hops", "10.0.0.1:1234", []string{"10.1.1.1, 10.2.2.2"}, "", "10.1.1.1"},
+		{"malformed hop stops the walk", "10.0.0.1:1234", []string{"198.51.100.7, garbage, 10.1.1.1"}, "", "10.1.1.1"},
+		{"malformed last hop", "10.0.0.1:1234", []string{"198.51.100.7, 999.1.1.1"}, "", "10.0.0.1"},
+		{"forwarded header wins over real IP", "10.0.0.1:1234", []string{"198.51.100.7"}, "198.51.100.8", "198.51.100.7"},
+		{"real IP", "10.0.0.1:1234", nil, "198.51.100.8", "198.51.100.8"},
+		{"malformed real IP", "10.0.0.1:1234", nil, "garbage", "10.0.0.1"},
+		{"peer without port", "10.0.0.1", []string{"198.51.100.7"}, "", "198.51.100.7"},
+		{"malformed peer", "garbage", []string{"198.51.100.7"}, "", "<nil>"},
+		{"IPv6 trusted peer", "[fd00::1]:443", []string{"2001:db8::1"}, "", "2001:db8::1"},
+		{"IPv6 untrusted peer", "[2001:db8::2]:443", []string{"2001:db8::1"}, "", "2001:db8::2"},
+		{"IPv6 chain", "[fd00::1]:443", []string{"2001:db8::1, fd00::2"}, "", "2001:db8::1"},
+		{"mixed families", "10.0.0.1:1234", []string{"2001:db8::1, fd00::2, 10.1.1.1"}, "", "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := http.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remote
+			for _, v := range tt.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if tt.xri != "" {
+				r.Header.Set("X-Real-IP", tt.xri)
+			}
+			if got := proxies.ClientIP(r).String(); got != tt.want {
+				t.Errorf("ClientIP() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFingerprintMismatch(t *testing.T) {
+	tests := []struct {
+		name              string
+		recorded, current string
+		want              string
+	}{
+		{"equal", "ua=1;ip=2", "ua=1;ip=2", ""},
+		{"one differs", "ua=1;ip=2", "ua=1;ip=3", "ip"},
+		{"all differ", "ua=1;ip=2", "ua=4;ip=3", "ua,ip"},
+		{"newly bound attribute", "ua=1", "ua=1;ip=2", ""},
+		{"no longer bound attribute", "ua=1;ip=2", "ua=1", ""},
+		{"never bound", "", "ua=1", ""},
+		{"malformed parts", "ua=1;junk;ip", "ua=1;ip=2", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := fingerprintMismatch(tt.recorded, tt.current); got != tt.want {
+				t.Errorf("fingerprintMismatch(%q, %q) = %q, want %q", tt.recorded, tt.current, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFingerprintIPPrefix(t *testing.T) {
+	proxies, err := ParseTrustedProxies("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &SentinelFailoverStore{trustedProxies: proxies}
+	config := BindingConfig{IPv4Prefix: 24, IPv6Prefix: 64}
+	tests := []struct {
+		name     string
+		from, to string
+		mismatch string
+	}{
+		{"same IPv4 network", "198.51.100.7", "198.51.100.200", ""},
+		{"other IPv4 network", "198.51.100.7", "198.51.101.7", "ip"},
+		{"same IPv6 network", "2001:db8:0:1::1", "2001:db8:0:1:ffff::2", ""},
+		{"other IPv6 network", "2001:db8:0:1::1", "2001:db8:0:2::1", "ip"},
+		{"family change", "198.51.100.7", "2001:db8::1", "ip"},
+	}
+	fingerprint := func(ip string) string {
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.RemoteAddr = "10.0.0.1:1234"
+		r.Header.Set("X-Forwarded-For", ip)
+		return s.fingerprint(r, config)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := fingerprintMismatch(fingerprint(tt.from), fingerprint(tt.to)); got != tt.mismatch {
+				t.Errorf("mismatch = %q, want %q", got, tt.mismatch)
+			}
+		})
+	}
+}
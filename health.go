@@ -0,0 +1,284 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package redisbackendhttpsessionstore
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"gopkg.in/redis.v3"
+)
+
+// Health status values reported by HealthStatus.Status.
+const (
+	HealthOK       = "ok"
+	HealthDegraded = "degraded"
+	HealthDown     = "down"
+)
+
+// Timeout used when dialing and querying each Sentinel for health reports.
+var sentinelHealthTimeout = 2 * time.Second
+
+// SentinelStatus is the state of a single configured Sentinel.
+type SentinelStatus struct {
+	Address    string `json:"address"`
+	Reachable  bool   `json:"reachable"`
+	MasterAddr string `json:"master_addr,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// ReplicaStatus is a replica of the monitored master as seen by Sentinel.
+type ReplicaStatus struct {
+	Address string `json:"address"`
+	Flags   string `json:"flags,omitempty"`
+}
+
+// ProbeStatus is the outcome of the write/read/delete round trip probe.
+type ProbeStatus struct {
+	OK      bool    `json:"ok"`
+	Latency float64 `json:"latency_ms"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// HealthStatus is the JSON document served by HealthHandler.
+type HealthStatus struct {
+	Status       string           `json:"status"`
+	MasterName   string           `json:"master_name"`
+	MasterAddr   string           `json:"master_addr,omitempty"`
+	Sentinels    []SentinelStatus `json:"sentinels"`
+	Replicas     []ReplicaStatus  `json:"replicas"`
+	LastFailover *time.Time       `json:"last_failover,omitempty"`
+	PingLatency  float64          `json:"ping_latency_ms"`
+	PingError    string           `json:"ping_error,omitempty"`
+	Probe        ProbeStatus      `json:"probe"`
+}
+
+// healthState remembers the master address between checks, so a change of
+// address can be reported as the time of the last failover.
+type healthState struct {
+	mu           sync.Mutex
+	masterAddr   string
+	lastFailover time.Time
+}
+
+func (h *healthState) observe(addr string) *time.Time {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if addr != "" && addr != h.masterAddr {
+		if h.masterAddr != "" {
+			h.lastFailover = time.Now()
+		}
+		h.masterAddr = addr
+	}
+	if h.lastFailover.IsZero() {
+		return nil
+	}
+	t := h.lastFailover
+	return &t
+}
+
+// Health queries every configured Sentinel and the current master, and
+// runs a write/read/delete probe against the session keyspace.
+//
+// Status is "ok" when the probe succeeds and every Sentinel answers,
+// "degraded" when the probe succeeds but some Sentinels do not, and "down"
+// when the master cannot serve sessions.
+func (s *SentinelFailoverStore) Health() *HealthStatus {
+	status := &HealthStatus{
+		MasterName: s.failoverOption.MasterName,
+		Sentinels:  make([]SentinelStatus, 0, len(s.failoverOption.Addresses)),
+		Replicas:   []ReplicaStatus{},
+	}
+
+	reachable := 0
+	for _, addr := range s.failoverOption.Addresses {
+		st, replicas := s.querySentinel(addr)
+		if st.Reachable {
+			reachable++
+			if status.MasterAddr == "" {
+				status.MasterAddr = st.MasterAddr
+				status.Replicas = replicas
+			}
+		}
+		status.Sentinels = append(status.Sentinels, st)
+	}
+	status.LastFailover = s.health.observe(status.MasterAddr)
+
+	start := time.Now()
+	if err := s.FailoverClient.Ping().Err(); err != nil {
+		status.PingError = err.Error()
+	}
+	status.PingLatency = milliseconds(time.Since(start))
+
+	status.Probe = s.probe()
+
+	switch {
+	case !status.Probe.OK:
+		status.Status = HealthDown
+	case reachable < len(s.failoverOption.Addresses):
+		status.Status = HealthDegraded
+	default:
+		status.Status = HealthOK
+	}
+	return status
+}
+
+// querySentinel asks a single Sentinel for the master address and replicas.
+func (s *SentinelFailoverStore) querySentinel(addr string) (SentinelStatus, []ReplicaStatus) {
+	st := SentinelStatus{Address: addr}
+	client := redis.NewClient(&redis.Options{
+		Addr:         addr,
+		DialTimeout:  sentinelHealthTimeout,
+		ReadTimeout:  sentinelHealthTimeout,
+		WriteTimeout: sentinelHealthTimeout,
+	})
+	defer client.Close()
+
+	master := redis.NewStringSliceCmd("SENTINEL", "get-master-addr-by-name",
+		s.failoverOption.MasterName)
+	client.Process(master)
+	hostport, err := master.Result()
+	if err != nil {
+		st.Error = err.Error()
+		return st, nil
+	}
+	st.Reachable = true
+	if len(hostport) == 2 {
+		st.MasterAddr = hostport[0] + ":" + hostport[1]
+	}
+
+	slaves := redis.NewSliceCmd("SENTINEL", "slaves", s.failoverOption.MasterName)
+	client.Process(slaves)
+	replies, err := slaves.Result()
+	if err != nil {
+		return st, nil
+	}
+	replicas := make([]ReplicaStatus, 0, len(replies))
+	for _, reply := range replies {
+		fields := replyFields(reply)
+		replicas = append(replicas, ReplicaStatus{
+			Address: fields["ip"] + ":" + fields["port"],
+			Flags:   fields["flags"],
+		})
+	}
+	return st, replicas
+}
+
+// replyFields turns a flat name/value reply, e.g. of SENTINEL, into a map.
+func replyFields(reply interface{}) map[string]string {
+	fields := make(map[string]string)
+	items, ok := reply.([]interface{})
+	if !ok {
+		return fields
+	}
+	for i := 0; i+1 < len(items); i += 2 {
+		name, _ := items[i].(string)
+		value, _ := items[i+1].(string)
+		fields[name] = value
+	}
+	return fields
+}
+
+// probe writes, reads back and deletes a short lived key next to the
+// session keys. The key is kept outside the session prefix so that it is
+// never taken for a session.
+func (s *SentinelFailoverStore) probe() (p ProbeStatus) {
+	key := "healthcheck_" + s.keyPrefix + hex.EncodeToString(securecookie.GenerateRandomKey(8))
+	value := securecookie.GenerateRandomKey(16)
+
+	start := time.Now()
+	defer func() { p.Latency = milliseconds(time.Since(start)) }()
+
+	if err := s.FailoverClient.Set(key, value, 10*time.Second).Err(); err != nil {
+		p.Error = err.Error()
+		return p
+	}
+	got, err := s.FailoverClient.Get(key).Bytes()
+	if err != nil {
+		p.Error = err.Error()
+		return p
+	}
+	if err := s.FailoverClient.Del(key).Err(); err != nil {
+		p.Error = err.Error()
+		return p
+	}
+	if !bytes.Equal(got, value) {
+		p.Error = "probe value mismatch"
+		return p
+	}
+	p.OK = true
+	return p
+}
+
+// HealthHandler serves the full HealthStatus as JSON. It responds 200 unless
+// the status is "down", in which case it responds 503.
+func (s *SentinelFailoverStore) HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := s.Health()
+		code := http.StatusOK
+		if status.Status == HealthDown {
+			code = http.StatusServiceUnavailable
+		}
+		writeHealth(w, code, status)
+	})
+}
+
+// LivenessHandler is meant for a Kubernetes liveness probe. It only reports
+// that the process serves HTTP, so an unreachable Redis does not get pods
+// restarted.
+func (s *SentinelFailoverStore) LivenessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, http.StatusOK, map[string]string{"status": HealthOK})
+	})
+}
+
+// ReadinessHandler is meant for a Kubernetes readiness probe. It responds 503
+// until the store is ready and the master answers a ping and passes the
+// round trip probe.
+func (s *SentinelFailoverStore) ReadinessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		result := map[string]interface{}{"status": HealthOK}
+		code := http.StatusOK
+		if !s.Ready() {
+			result["status"] = HealthDown
+			result["error"] = ErrNotReady.Error()
+			code = http.StatusServiceUnavailable
+		} else if err := s.FailoverClient.Ping().Err(); err != nil {
+			result["status"] = HealthDown
+			result["error"] = err.Error()
+			code = http.StatusServiceUnavailable
+		} else if p := s.probe(); !p.OK {
+			result["status"] = HealthDown
+			result["probe"] = p
+			code = http.StatusServiceUnavailable
+		}
+		writeHealth(w, code, result)
+	})
+}
+
+func writeHealth(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,98 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package redisbackendhttpsessionstore
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/sessions"
+)
+
+// SessionHook is called synchronously with the request and the session.
+type SessionHook func(r *http.Request, session *sessions.Session)
+
+// SaveHook is called before a session is written. It may change the
+// session; returning an error vetoes the save and Save returns that error.
+type SaveHook func(r *http.Request, session *sessions.Session) error
+
+// hookRegistry holds the lifecycle hooks of a store.
+type hookRegistry struct {
+	mu         sync.RWMutex
+	create     []SessionHook
+	load       []SessionHook
+	beforeSave []SaveHook
+	afterSave  []SessionHook
+	destroy    []SessionHook
+	validators []Validator
+}
+
+// OnCreate registers fn to run when Save assigns an ID to a new session,
+// before it is written.
+func (s *SentinelFailoverStore) OnCreate(fn SessionHook) {
+	s.hooks.mu.Lock()
+	defer s.hooks.mu.Unlock()
+	s.hooks.create = append(s.hooks.create, fn)
+}
+
+// OnLoad registers fn to run when New has loaded an existing session.
+func (s *SentinelFailoverStore) OnLoad(fn SessionHook) {
+	s.hooks.mu.Lock()
+	defer s.hooks.mu.Unlock()
+	s.hooks.load = append(s.hooks.load, fn)
+}
+
+// OnBeforeSave registers fn to run before a session is written. Hooks run
+// in registration order and the first error stops the save.
+func (s *SentinelFailoverStore) OnBeforeSave(fn SaveHook) {
+	s.hooks.mu.Lock()
+	defer s.hooks.mu.Unlock()
+	s.hooks.beforeSave = append(s.hooks.beforeSave, fn)
+}
+
+// OnAfterSave registers fn to run after a session was written.
+func (s *SentinelFailoverStore) OnAfterSave(fn SessionHook) {
+	s.hooks.mu.Lock()
+	defer s.hooks.mu.Unlock()
+	s.hooks.afterSave = append(s.hooks.afterSave, fn)
+}
+
+// OnDestroy registers fn to run after Save deleted a session because its
+// MaxAge is negative, and after Login evicted one, see LimitSessions.
+func (s *SentinelFailoverStore) OnDestroy(fn SessionHook) {
+	s.hooks.mu.Lock()
+	defer s.hooks.mu.Unlock()
+	s.hooks.destroy = append(s.hooks.destroy, fn)
+}
+
+func (s *SentinelFailoverStore) runHooks(hooks *[]SessionHook, r *http.Request, session *sessions.Session) {
+	s.hooks.mu.RLock()
+	fns := *hooks
+	s.hooks.mu.RUnlock()
+	for _, fn := range fns {
+		fn(r, session)
+	}
+}
+
+func (s *SentinelFailoverStore) runBeforeSave(r *http.Request, session *sessions.Session) error {
+	s.hooks.mu.RLock()
+	fns := s.hooks.beforeSave
+	s.hooks.mu.RUnlock()
+	for _, fn := range fns {
+		if err := fn(r, session); err != nil {
+			return err
+		}
+	}
+	return nil
+}
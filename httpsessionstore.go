@@ -14,11 +14,9 @@ limitations under the License.
 package redisbackendhttpsessionstore
 
 import (
-    "fmt"
+    "context"
     "net/http"
-    "strings"
-    "encoding/base32"
-    "errors"
+    "sync"
     "time"
     "github.com/gorilla/securecookie"
     "github.com/gorilla/sessions"
@@ -34,21 +32,25 @@ var sessionExpire = 86400 * 30
 type SentinelClientConfig struct {
     MasterName string
     Addresses []string
+    // Logger receives connection events and becomes the logger of the
+    // store. Nil keeps the store silent.
+    Logger Logger
+    // NotReadyPolicy applies until the master answered the first ping.
+    NotReadyPolicy NotReadyPolicy
+    // DB is the database holding the session keys.
+    DB int64
 }
 
+// newSentinelFailoverClient does not touch the network, the connection is
+// established by the store in the background.
 func (c *SentinelClientConfig)newSentinelFailoverClient() *redis.Client {
     // See http://redis.io/topics/sentinel for instructions how to
     // setup Redis Sentinel.
     client := redis.NewFailoverClient(&redis.FailoverOptions{
         MasterName: c.MasterName,
         SentinelAddrs: c.Addresses,
+        DB: c.DB,
     })
-    if pong, err := client.Ping().Result(); err != nil {
-        fmt.Println("Sentinel currently unable to response, ", 
-                "please try Ping laterly when to access")
-    } else {
-        fmt.Println(pong)
-    }
     return client
 }
 
@@ -68,10 +70,35 @@ type SentinelFailoverStore struct {
 	maxLength          int
 	keyPrefix          string
 	serializer         redistore.SessionSerializer
+	health             healthState
+	metrics            syncMetrics
+	logger             syncLogger
+	ready              chan struct{}
+	life               lifecycle
+	expiration         expirationListener
+	audit              *AuditConfig
+	hooks              hookRegistry
+	trustedProxies     TrustedProxies
+	binding            *BindingConfig
+	sessionLimit       *SessionLimitConfig
+	chunking           *ChunkConfig
+	transports         []Transport
+	batches            sync.Map
+	keysMu             sync.RWMutex
+	keyPairs           []KeyPair
+	cookieMaxLength    *int
+	idGenerator        IDGenerator
+	legacyIDs          []IDGenerator
+	keyHash            *KeyHashConfig
+	atomicFields       map[string]FieldKind
 }
 
 // This function returns a new Redis Sentinel store.
 //
+// It returns immediately and connects in the background. Use WaitReady to
+// block until the master is reachable; until then requests are served
+// according to clientConfig.NotReadyPolicy.
+//
 // Keys are defined in pairs to allow key rotation, but the common case is
 // to set a single authentication key and optionally an encryption key.
 //
@@ -87,6 +114,10 @@ type SentinelFailoverStore struct {
 // strong keys.
 func NewSentinelFailoverStore(clientConfig SentinelClientConfig, 
         keyPairs ...[]byte) *SentinelFailoverStore {
+	var logger Logger = nopLogger{}
+	if clientConfig.Logger != nil {
+		logger = clientConfig.Logger
+	}
 	client := clientConfig.newSentinelFailoverClient()
 	s := &SentinelFailoverStore{ 
 		RediStore: &redistore.RediStore {
@@ -102,15 +133,21 @@ func NewSentinelFailoverStore(clientConfig SentinelClientConfig,
 	    },
 		failoverOption: clientConfig,
 		FailoverClient: client,
+		keyPairs:       keyPairsOf(keyPairs),
 		maxLength:     4096,
 		keyPrefix:     "session_",
 		serializer: redistore.GobSerializer{},
+		ready:      make(chan struct{}),
+		life:       lifecycle{done: make(chan struct{})},
 	}
 
     s.SetMaxLength(s.maxLength)
     s.SetKeyPrefix(s.keyPrefix)
     s.SetSerializer(s.serializer)
 	s.MaxAge(s.Options.MaxAge)
+	s.SetMetrics(DefaultMetrics())
+	s.SetLogger(logger)
+	s.goBackground(s.connect)
 	return s
 }
 
@@ -118,11 +155,10 @@ func NewSentinelFailoverStore(clientConfig SentinelClientConfig,
 // If l is 0 there is no limit to the size of a session, use with caution.
 // The default for a new SentinelFailoverStore is 4096.
 func (s *SentinelFailoverStore) MaxLength(l int) {
-	for _, c := range s.Codecs {
-		if codec, ok := c.(*securecookie.SecureCookie); ok {
-			codec.MaxLength(l)
-		}
-	}
+	s.keysMu.Lock()
+	defer s.keysMu.Unlock()
+	s.cookieMaxLength = &l
+	s.configureCodecs()
 }
 
 // Get returns a session for the given name after adding it to the registry.
@@ -131,7 +167,8 @@ func (s *SentinelFailoverStore) MaxLength(l int) {
 // the session to check if it is an existing session or a new one.
 //
 // It returns a new session and an error if the session exists but could
-// not be decoded.
+// not be decoded. It returns a *ValidationError if a validator refused the
+// session, see AddValidator.
 func (s *SentinelFailoverStore) Get(r *http.Request, name string) (*sessions.Session, error) {
 	return sessions.GetRegistry(r).Get(s, name)
 }
@@ -146,45 +183,114 @@ func (s *SentinelFailoverStore) New(r *http.Request, name string) (*sessions.Ses
 	opts := *s.Options
 	session.Options = &opts
 	session.IsNew = true
+	if !s.Ready() {
+		if s.failoverOption.NotReadyPolicy == NotReadyDegraded {
+			return session, nil
+		}
+		return session, ErrNotReady
+	}
 	var err error
-	if c, errCookie := r.Cookie(name); errCookie == nil {
-		err = securecookie.DecodeMulti(name, c.Value, &session.ID, s.Codecs...)
-		if err == nil {
-			err = s.load(session)
-			if err == nil {
+	if value, _, ok := s.readSession(r, name); ok {
+		err = securecookie.DecodeMulti(name, value, &session.ID, s.codecs()...)
+		if err == nil && !s.validID(session.ID) {
+			err = errMalformedID
+		}
+		if err != nil {
+			s.metrics.Error(OpLoad, ErrKindCookie)
+			s.logError(r.Context(), OpLoad, "", "session cookie could not be decoded", err,
+				"name", name)
+			session.ID = ""
+			err = cookieError(err)
+		} else {
+			err = s.load(r.Context(), session)
+			if err == ErrSessionNotFound {
+				// An expired session is not an error, the caller gets a
+				// fresh one under a new ID.
+				session.ID = ""
+				err = nil
+			} else if err == nil {
 				session.IsNew = false
+				if session, err = s.validate(r, session); session.IsNew {
+					return session, err
+				}
+				s.runHooks(&s.hooks.load, r, session)
 			}
 		}
 	}
 	return session, err
 }
 
-// Save adds a single session to the response.
+// Save adds a single session to the response. A session returned by
+// GetMulti is saved together with the rest of its batch.
 func (s *SentinelFailoverStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if batched, err := s.saveBatched(r, w, session); batched {
+		return err
+	}
+	return s.saveOne(r, w, session)
+}
+
+// saveOne saves a single session on its own.
+func (s *SentinelFailoverStore) saveOne(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if !s.Ready() {
+		if s.failoverOption.NotReadyPolicy == NotReadyDegraded {
+			return nil
+		}
+		return ErrNotReady
+	}
+	if err := s.begin(); err != nil {
+		return err
+	}
+	defer s.end()
     if session.Options.MaxAge < 0 {
-		if err := s.delete(session); err != nil {
+		if err := s.delete(r.Context(), session); err != nil {
 			return err
 		}
-		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		s.writeSession(w, r, session.Name(), "", session.Options)
+		// Failures are logged by Audit, they must not fail the request.
+		s.Audit(r, session, AuditDestroyed)
+		s.runHooks(&s.hooks.destroy, r, session)
 		return nil
 	}
-	if session.ID == "" {
-		// Because the ID is not initialized when newly created, encode it to
-		// use alphanumeric characters only.
-		session.ID = strings.TrimRight(
-			base32.StdEncoding.EncodeToString(
-				securecookie.GenerateRandomKey(32)), "=")
+	created, err := s.prepareSave(r, session)
+	if err != nil {
+		return err
 	}
-	if err := s.save(session); err != nil {
+	if err := s.save(r.Context(), session); err != nil {
 		return err
 	}
+	return s.finishSave(r, w, session, created)
+}
+
+// prepareSave assigns the ID of a new session and runs the hooks due before
+// it is written. It reports whether the session was created.
+func (s *SentinelFailoverStore) prepareSave(r *http.Request, session *sessions.Session) (bool, error) {
+	created := session.ID == ""
+	if created {
+		session.ID = s.newID()
+		s.runHooks(&s.hooks.create, r, session)
+	}
+	if err := s.runBeforeSave(r, session); err != nil {
+		if created {
+			session.ID = ""
+		}
+		return false, err
+	}
+	return created, nil
+}
+
+// finishSave hands a written session to the client.
+func (s *SentinelFailoverStore) finishSave(r *http.Request, w http.ResponseWriter, session *sessions.Session, created bool) error {
+	if created {
+		s.Audit(r, session, AuditCreated)
+	}
 	
 	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID,
-		s.Codecs...)
+		s.codecs()...)
 	if err != nil {
 		return err
 	}
-	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	s.writeSession(w, r, session.Name(), encoded, session.Options)
+	s.runHooks(&s.hooks.afterSave, r, session)
 	return nil
 }
 
@@ -195,47 +301,138 @@ func (s *SentinelFailoverStore) MaxAge(age int) {
 	s.Options.MaxAge = age
 
 	// Set the maxAge for each securecookie instance.
-	for _, codec := range s.Codecs {
-		if sc, ok := codec.(*securecookie.SecureCookie); ok {
-			sc.MaxAge(age)
-		}
-	}
+	s.keysMu.Lock()
+	defer s.keysMu.Unlock()
+	s.configureCodecs()
 }
 
 // save writes encoded session.Values to a file.
-func (s *SentinelFailoverStore) save(session *sessions.Session) error {
+func (s *SentinelFailoverStore) save(ctx context.Context, session *sessions.Session) error {
 	//encoded, err := securecookie.EncodeMulti(session.Name(), session.Values, 
 	//        s.Codecs...)
-	data, err := s.serializer.Serialize(session)
+	e, err := s.encode(ctx, session)
 	if err != nil {
 		return err
 	}
+	start := time.Now()
+	if e.chunked {
+		err = s.writeChunks(session.ID, e.data, e.ttl)
+	} else {
+		err = s.FailoverClient.Set(s.sessionKey(session.ID), e.data, e.ttl).Err()
+	}
+	s.metrics.Redis(OpSave, time.Since(start))
+	return s.written(ctx, session, e, err)
+}
+
+// encodedSession is a serialized session ready to be written.
+type encodedSession struct {
+	data    []byte
+	ttl     time.Duration
+	chunked bool
+	encode  time.Duration
+}
+
+// encode serializes session and checks its size.
+func (s *SentinelFailoverStore) encode(ctx context.Context, session *sessions.Session) (encodedSession, error) {
+	start := time.Now()
+	data, err := s.serializer.Serialize(s.withoutFields(session))
+	if err != nil {
+		s.metrics.Error(OpSave, ErrKindSerialize)
+		s.logError(ctx, OpSave, session.ID, "session could not be serialized", err)
+		return encodedSession{}, decodeError(err)
+	}
+	encode := time.Since(start)
 	//filename := filepath.Join(s.path, "session_"+session.ID)
 	//fileMutex.Lock()
 	//defer fileMutex.Unlock()
 	//return ioutil.WriteFile(filename, []byte(encoded), 0600)
 	
+	chunked := false
 	if s.maxLength != 0 && len(data) > s.maxLength {
-		return errors.New("SessionStore: the value to store is too big")
+		limit := s.maxLength
+		if s.chunking != nil {
+			limit = s.chunking.MaxSize
+			chunked = len(data) <= limit
+		}
+		if !chunked {
+			s.metrics.TooBig(len(data), limit)
+			s.metrics.Error(OpSave, ErrKindTooBig)
+			err = &SessionTooLargeError{Size: len(data), Limit: limit}
+			s.logError(ctx, OpSave, session.ID, "session exceeds maximum length", err,
+				"size", len(data), "limit", limit)
+			return encodedSession{}, err
+		}
 	}
 	age := session.Options.MaxAge
 	if age == 0 {
 		age = s.DefaultMaxAge
 	}
-	return s.FailoverClient.Set("session_"+session.ID, data, time.Duration(age) * time.Second).Err()
+	ttl := time.Duration(age) * time.Second
+	return encodedSession{data: data, ttl: ttl, chunked: chunked, encode: encode}, nil
+}
+
+// written reports the outcome err of writing an encoded session.
+func (s *SentinelFailoverStore) written(ctx context.Context, session *sessions.Session, e encodedSession, err error) error {
+	if err != nil {
+		s.metrics.Error(OpSave, ErrKindRedis)
+		s.logError(ctx, OpSave, session.ID, "session could not be written", err)
+		return backendError(err)
+	}
+	if err = s.saveShadow(session, e.ttl); err != nil {
+		s.logError(ctx, OpSave, session.ID, "shadow key could not be written", err)
+	}
+	if err = s.expireFields(session.ID, e.ttl); err != nil {
+		s.logError(ctx, OpSave, session.ID, "session fields TTL could not be set", err)
+	}
+	s.metrics.Save(len(e.data), e.encode)
+	return nil
 }
 
 // load reads a key and decodes its content into session.Values.
-func (s *SentinelFailoverStore) load(session *sessions.Session) error {
+func (s *SentinelFailoverStore) load(ctx context.Context, session *sessions.Session) error {
 	//filename := filepath.Join(s.path, "session_"+session.ID)
 	//fileMutex.RLock()
 	//defer fileMutex.RUnlock()
 	//fdata, err := ioutil.ReadFile(filename)
-	data, err := s.FailoverClient.Get("session_"+session.ID).Bytes()
+	var stored storedSession
+	var err error
+	stored, found := prefetched(ctx, session.ID)
+	switch {
+	case found && stored.data != nil:
+	case s.migrating():
+		// A prefetched miss too, the session may still be under its
+		// plain key.
+		start := time.Now()
+		stored, err = s.migrateKey(ctx, session.ID)
+		s.metrics.Redis(OpLoad, time.Since(start))
+	case found:
+		err = redis.Nil
+	default:
+		start := time.Now()
+		stored, err = s.readStored(session.ID)
+		s.metrics.Redis(OpLoad, time.Since(start))
+	}
+	data := stored.data
+	if _, ok := chunkCount(data); ok && err == nil {
+		data, err = s.readChunks(session.ID)
+	}
+	if err == redis.Nil {
+		s.metrics.Load(false, 0, 0)
+		return ErrSessionNotFound
+	}
 	if err != nil {
-	    return err
+		s.metrics.Error(OpLoad, ErrKindRedis)
+		s.logError(ctx, OpLoad, session.ID, "session could not be read", err)
+		return backendError(err)
+	}
+	start := time.Now()
+	if err = s.serializer.Deserialize(data, session); err != nil {
+		s.metrics.Error(OpLoad, ErrKindDeserialize)
+		s.logError(ctx, OpLoad, session.ID, "session could not be deserialized", err)
+		return decodeError(err)
 	}
-	return s.serializer.Deserialize(data, session)
+	s.metrics.Load(true, len(data), time.Since(start))
+	return s.loadFields(ctx, session, stored.fields)
 	//if err = securecookie.DecodeMulti(session.Name(), string(fdata),
 	//	&session.Values, s.Codecs...); err != nil {
 	//	return err
@@ -243,13 +440,48 @@ func (s *SentinelFailoverStore) load(session *sessions.Session) error {
 	//return nil
 }
 
+// deleteSessionLua defines delete_session(prefix, sid), which deletes the
+// session key of storage ID sid together with its chunks, shadow key and
+// atomic fields. It is shared by every script removing a session.
+const deleteSessionLua = `
+local function delete_session(prefix, sid)
+	local key = prefix .. sid
+	local head = redis.call('GETRANGE', key, 0, 31)
+	if string.sub(head, 1, 9) == '\0chunked:' then
+		for i = 0, (tonumber(string.sub(head, 10)) or 0) - 1 do
+			redis.call('DEL', 'chunk_' .. key .. '_' .. i)
+		end
+	end
+	return redis.call('DEL', key, 'shadow_' .. key, 'fields_' .. key)
+end
+`
+
+// deleteSessionScript deletes a session. ARGV[1] is the key prefix and
+// ARGV[2] the storage ID.
+const deleteSessionScript = deleteSessionLua + `return delete_session(ARGV[1], ARGV[2])`
+
 // delete removes keys from redis if MaxAge<0
-func (s *SentinelFailoverStore) delete(session *sessions.Session) error {
+func (s *SentinelFailoverStore) delete(ctx context.Context, session *sessions.Session) error {
 	//conn := s.Pool.Get()
 	//defer conn.Close()
 	//if _, err := conn.Do("DEL", s.keyPrefix+session.ID); err != nil {
 	//	return err
 	//}
 	//return nil
-	return s.FailoverClient.Del("session_" + session.ID).Err()
+	start := time.Now()
+	err := s.FailoverClient.Eval(deleteSessionScript, nil,
+		[]string{s.keyPrefix, s.storageID(session.ID)}).Err()
+	s.metrics.Redis(OpDelete, time.Since(start))
+	if err != nil {
+		s.metrics.Error(OpDelete, ErrKindRedis)
+		s.logError(ctx, OpDelete, session.ID, "session could not be deleted", err)
+		return backendError(err)
+	}
+	s.metrics.Delete()
+	return nil
+}
+
+// sessionKey returns the Redis key holding the session with the given ID.
+func (s *SentinelFailoverStore) sessionKey(id string) string {
+	return s.storageKey(s.storageID(id))
 }
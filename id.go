@@ -0,0 +1,192 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package redisbackendhttpsessionstore
+
+import (
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gorilla/securecookie"
+)
+
+// errMalformedID is reported, wrapped in ErrCookieInvalid, for a cookie
+// whose ID no generator of the store accepts.
+var errMalformedID = errors.New("SessionStore: malformed session ID")
+
+// IDGenerator creates session IDs and recognizes the IDs it creates.
+type IDGenerator interface {
+	NewID() string
+	// Valid reports whether id is well formed. It is checked on every
+	// cookie before the session is read, so it must be cheap.
+	Valid(id string) bool
+}
+
+// RandomIDGenerator creates the base32 encoding of 32 random bytes, the
+// default.
+type RandomIDGenerator struct{}
+
+func (RandomIDGenerator) NewID() string {
+	// Because the ID is not initialized when newly created, encode it to
+	// use alphanumeric characters only.
+	return strings.TrimRight(
+		base32.StdEncoding.EncodeToString(
+			securecookie.GenerateRandomKey(32)), "=")
+}
+
+func (RandomIDGenerator) Valid(id string) bool {
+	return len(id) == 52 && onlyRunes(id, "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567")
+}
+
+// crockford is the alphabet of ULIDs.
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ULIDGenerator creates 26 character ULIDs: a millisecond timestamp
+// followed by 80 random bits, in Crockford base32. They sort by creation
+// time, which helps debugging and range scans, at the cost of disclosing
+// when a session was created.
+type ULIDGenerator struct{}
+
+func (ULIDGenerator) NewID() string {
+	var id [16]byte
+	ms := uint64(time.Now().UnixNano() / int64(time.Millisecond))
+	for i := 5; i >= 0; i-- {
+		id[i] = byte(ms)
+		ms >>= 8
+	}
+	copy(id[6:], securecookie.GenerateRandomKey(10))
+
+	// 128 bits in 26 characters of 5 bits, the first one carries 3.
+	out := make([]byte, 26)
+	var acc uint64
+	bits := 0
+	pos := 25
+	for i := 15; i >= 0; i-- {
+		acc |= uint64(id[i]) << uint(bits)
+		bits += 8
+		for bits >= 5 && pos >= 0 {
+			out[pos] = crockford[acc&31]
+			acc >>= 5
+			bits -= 5
+			pos--
+		}
+	}
+	out[0] = crockford[acc&7]
+	return string(out)
+}
+
+func (ULIDGenerator) Valid(id string) bool {
+	return len(id) == 26 && id[0] <= '7' && onlyRunes(id, crockford)
+}
+
+// ULIDTime returns the creation time encoded in a ULID session ID.
+func ULIDTime(id string) (time.Time, bool) {
+	if !(ULIDGenerator{}).Valid(id) {
+		return time.Time{}, false
+	}
+	var ms int64
+	for _, c := range id[:10] {
+		ms = ms<<5 | int64(strings.IndexRune(crockford, c))
+	}
+	return time.Unix(ms/1000, ms%1000*int64(time.Millisecond)), true
+}
+
+// TaggedIDGenerator prefixes the IDs of Base with a shard or region tag
+// and a dash, e.g. "eu1-01H...", so a router can send a request to the
+// right backend without reading the session. Valid accepts any tag of up
+// to 16 letters and digits, so sessions created in another region keep
+// working. Tag itself must be such a tag, see SetIDGenerator.
+type TaggedIDGenerator struct {
+	Tag  string
+	Base IDGenerator
+}
+
+func (g TaggedIDGenerator) NewID() string {
+	return g.Tag + "-" + g.base().NewID()
+}
+
+func (g TaggedIDGenerator) Valid(id string) bool {
+	tag, rest, ok := strings.Cut(id, "-")
+	return ok && tag != "" && len(tag) <= 16 &&
+		onlyRunes(strings.ToLower(tag), "abcdefghijklmnopqrstuvwxyz0123456789") &&
+		g.base().Valid(rest)
+}
+
+func (g TaggedIDGenerator) base() IDGenerator {
+	if g.Base == nil {
+		return RandomIDGenerator{}
+	}
+	return g.Base
+}
+
+// IDTag returns the tag of an ID created by a TaggedIDGenerator, or "".
+func IDTag(id string) string {
+	tag, _, ok := strings.Cut(id, "-")
+	if !ok {
+		return ""
+	}
+	return tag
+}
+
+func onlyRunes(s, alphabet string) bool {
+	for _, c := range s {
+		if !strings.ContainsRune(alphabet, c) {
+			return false
+		}
+	}
+	return true
+}
+
+// SetIDGenerator sets the generator of new session IDs. IDs found in
+// cookies must be valid for gen or one of legacy, so list the previous
+// generator there while its sessions are still alive. The default is
+// RandomIDGenerator.
+//
+// It fails, keeping the current generator, when gen creates IDs its own
+// Valid rejects, e.g. a TaggedIDGenerator with a dash in its tag, which
+// would give every request a new session.
+func (s *SentinelFailoverStore) SetIDGenerator(gen IDGenerator, legacy ...IDGenerator) error {
+	if id := gen.NewID(); !gen.Valid(id) {
+		return fmt.Errorf("SessionStore: ID generator rejects its own ID %q", id)
+	}
+	s.idGenerator = gen
+	s.legacyIDs = legacy
+	return nil
+}
+
+// newID returns the ID of a new session.
+func (s *SentinelFailoverStore) newID() string {
+	if s.idGenerator == nil {
+		return RandomIDGenerator{}.NewID()
+	}
+	return s.idGenerator.NewID()
+}
+
+// validID reports whether id, decoded from a cookie, is well formed.
+func (s *SentinelFailoverStore) validID(id string) bool {
+	if s.idGenerator == nil {
+		return RandomIDGenerator{}.Valid(id)
+	}
+	if s.idGenerator.Valid(id) {
+		return true
+	}
+	for _, g := range s.legacyIDs {
+		if g.Valid(id) {
+			return true
+		}
+	}
+	return false
+}
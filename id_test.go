@@ -0,0 +1,162 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package redisbackendhttpsessionstore
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIDGeneratorsAcceptTheirIDs(t *testing.T) {
+	tests := []struct {
+		name string
+		gen  IDGenerator
+		len  int
+	}{
+		{"random", RandomIDGenerator{}, 52},
+		{"ulid", ULIDGenerator{}, 26},
+		{"tagged random", TaggedIDGenerator{Tag: "eu1"}, 56},
+		{"tagged ulid", TaggedIDGenerator{Tag: "EU1", Base: ULIDGenerator{}}, 30},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seen := make(map[string]bool)
+			for i := 0; i < 100; i++ {
+				id := tt.gen.NewID()
+				if len(id) != tt.len {
+					t.Fatalf("NewID() = %q, want %d characters", id, tt.len)
+				}
+				if !tt.gen.Valid(id) {
+					t.Fatalf("Valid(%q) = false", id)
+				}
+				if seen[id] {
+					t.Fatalf("NewID() repeated %q", id)
+				}
+				seen[id] = true
+			}
+		})
+	}
+}
+
+func TestIDGeneratorsRejectMalformedIDs(t *testing.T) {
+	random := RandomIDGenerator{}.NewID()
+	ulid := ULIDGenerator{}.NewID()
+	tests := []struct {
+		name string
+		gen  IDGenerator
+		id   string
+	}{
+		{"random empty", RandomIDGenerator{}, ""},
+		{"random short", RandomIDGenerator{}, random[1:]},
+		{"random lower case", RandomIDGenerator{}, strings.ToLower(random)},
+		{"random padded", RandomIDGenerator{}, random[1:] + "="},
+		{"random digit 1", RandomIDGenerator{}, "1" + random[1:]},
+		{"ulid empty", ULIDGenerator{}, ""},
+		{"ulid long", ULIDGenerator{}, ulid + "0"},
+		{"ulid overflow", ULIDGenerator{}, "8" + ulid[1:]},
+		{"ulid letter U", ULIDGenerator{}, ulid[:25] + "U"},
+		{"ulid as random", RandomIDGenerator{}, ulid},
+		{"tagged without tag", TaggedIDGenerator{}, random},
+		{"tagged empty tag", TaggedIDGenerator{}, "-" + random},
+		{"tagged long tag", TaggedIDGenerator{}, strings.Repeat("a", 17) + "-" + random},
+		{"tagged dash in tag", TaggedIDGenerator{}, "eu-1-" + random},
+		{"tagged wrong base", TaggedIDGenerator{Base: ULIDGenerator{}}, "eu1-" + random},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.gen.Valid(tt.id) {
+				t.Errorf("Valid(%q) = true", tt.id)
+			}
+		})
+	}
+}
+
+func TestULIDTime(t *testing.T) {
+	before := time.Now().Truncate(time.Millisecond)
+	id := ULIDGenerator{}.NewID()
+	after := time.Now()
+	got, ok := ULIDTime(id)
+	if !ok {
+		t.Fatalf("ULIDTime(%q) failed", id)
+	}
+	if got.Before(before) || got.After(after) {
+		t.Errorf("ULIDTime(%q) = %v, want between %v and %v", id, got, before, after)
+	}
+
+	tests := []struct {
+		id   string
+		want time.Time
+		ok   bool
+	}{
+		{"00000000000000000000000000", time.Unix(0, 0), true},
+		{"0000000001ZZZZZZZZZZZZZZZZ", time.Unix(0, int64(time.Millisecond)), true},
+		{"01ARZ3NDEKTSV4RRFFQ69G5FAV", time.Unix(1469922850, 259*int64(time.Millisecond)), true},
+		{"7ZZZZZZZZZZZZZZZZZZZZZZZZZ", time.Unix(281474976710, 655*int64(time.Millisecond)), true},
+		{"8ZZZZZZZZZZZZZZZZZZZZZZZZZ", time.Time{}, false},
+		{"not a ulid", time.Time{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := ULIDTime(tt.id)
+		if ok != tt.ok || !got.Equal(tt.want) {
+			t.Errorf("ULIDTime(%q) = %v, %v, want %v, %v", tt.id, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestIDTag(t *testing.T) {
+	tests := []struct {
+		id, want string
+	}{
+		{TaggedIDGenerator{Tag: "eu1"}.NewID(), "eu1"},
+		{"us2-01ARZ3NDEKTSV4RRFFQ69G5FAV", "us2"},
+		{RandomIDGenerator{}.NewID(), ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := IDTag(tt.id); got != tt.want {
+			t.Errorf("IDTag(%q) = %q, want %q", tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestSetIDGenerator(t *testing.T) {
+	tests := []struct {
+		name string
+		gen  IDGenerator
+		ok   bool
+	}{
+		{"random", RandomIDGenerator{}, true},
+		{"ulid", ULIDGenerator{}, true},
+		{"tagged", TaggedIDGenerator{Tag: "eu1"}, true},
+		{"tag with dash", TaggedIDGenerator{Tag: "eu-1"}, false},
+		{"tag too long", TaggedIDGenerator{Tag: strings.Repeat("a", 17)}, false},
+		{"empty tag", TaggedIDGenerator{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &SentinelFailoverStore{}
+			err := s.SetIDGenerator(tt.gen)
+			if (err == nil) != tt.ok {
+				t.Fatalf("SetIDGenerator() = %v, want ok %v", err, tt.ok)
+			}
+			if tt.ok && !s.validID(tt.gen.NewID()) {
+				t.Errorf("validID rejects an ID of the generator set")
+			}
+			if !tt.ok && s.idGenerator != nil {
+				t.Errorf("SetIDGenerator kept a generator it refused")
+			}
+		})
+	}
+}
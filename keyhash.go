@@ -0,0 +1,134 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package redisbackendhttpsessionstore
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+
+	"gopkg.in/redis.v3"
+)
+
+// KeyHashConfig configures hashed session keys.
+type KeyHashConfig struct {
+	// Secret keys the HMAC. It must be the same on all instances and must
+	// not be stored in Redis.
+	Secret []byte
+	// Migrate makes a load, or an operation on atomic fields, that misses
+	// the hashed key look for the plain key of earlier versions and rename
+	// it, together with its chunks, shadow key and atomic fields, in one
+	// script. Turn it off once the plain keys have expired.
+	//
+	// Session locks are always named after the hashed ID, whether the
+	// session was moved or not, so they need no migration as long as all
+	// instances hash the keys.
+	Migrate bool
+}
+
+// migrateScript returns the session under its hashed key, or else moves
+// it from its plain key, with its chunks, shadow key and atomic fields,
+// in one step. It returns nil when neither key exists, otherwise the value
+// of the session key, 1 if it was moved, and the atomic fields.
+//
+// ARGV[1] is the key prefix, ARGV[2] the plain ID and ARGV[3] the storage
+// ID.
+const migrateScript = `
+local hashed = ARGV[1] .. ARGV[3]
+local v = redis.call('GET', hashed)
+if v then
+	return {v, 0, redis.call('HGETALL', 'fields_' .. hashed)}
+end
+local plain = ARGV[1] .. ARGV[2]
+v = redis.call('GET', plain)
+if not v then
+	return false
+end
+local function move(from, to)
+	if redis.call('EXISTS', from) == 1 then
+		redis.call('RENAME', from, to)
+	end
+end
+move(plain, hashed)
+move('shadow_' .. plain, 'shadow_' .. hashed)
+move('fields_' .. plain, 'fields_' .. hashed)
+if string.sub(v, 1, 9) == '\0chunked:' then
+	for i = 0, (tonumber(string.sub(v, 10)) or 0) - 1 do
+		move('chunk_' .. plain .. '_' .. i, 'chunk_' .. hashed .. '_' .. i)
+	end
+end
+return {v, 1, redis.call('HGETALL', 'fields_' .. hashed)}`
+
+// HashSessionKeys makes the store name the Redis keys of a session after
+// the HMAC-SHA256 of its ID instead of the ID itself, so keys read from a
+// replica, a backup or MONITOR cannot be replayed as cookies.
+//
+// The hashed ID, rather than the ID, is then what expiration callbacks and
+// OnEvict receive, and what lock and principal keys are derived from.
+// Call it before serving requests.
+func (s *SentinelFailoverStore) HashSessionKeys(config KeyHashConfig) {
+	s.keyHash = &config
+}
+
+// storageID returns the ID session keys are derived from.
+func (s *SentinelFailoverStore) storageID(id string) string {
+	if s.keyHash == nil {
+		return id
+	}
+	mac := hmac.New(sha256.New, s.keyHash.Secret)
+	mac.Write([]byte(id))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// storageKey returns the session key of a storage ID.
+func (s *SentinelFailoverStore) storageKey(sid string) string {
+	return s.keyPrefix + sid
+}
+
+// migrating reports whether loads fall back to plain keys, see
+// KeyHashConfig.Migrate.
+func (s *SentinelFailoverStore) migrating() bool {
+	return s.keyHash != nil && s.keyHash.Migrate
+}
+
+// migrateKey reads the session key of id and its atomic fields, moving a
+// session stored under its plain ID to its hashed keys first, see
+// KeyHashConfig.Migrate. It returns redis.Nil when the session exists
+// under neither key.
+func (s *SentinelFailoverStore) migrateKey(ctx context.Context, id string) (storedSession, error) {
+	reply, err := s.FailoverClient.Eval(migrateScript, nil,
+		[]string{s.keyPrefix, id, s.storageID(id)}).Result()
+	if err != nil {
+		return storedSession{}, err
+	}
+	list, _ := reply.([]interface{})
+	if len(list) != 3 {
+		return storedSession{}, redis.Nil
+	}
+	data, _ := list[0].(string)
+	if moved, _ := list[1].(int64); moved == 1 {
+		s.logger.Log(ctx, slog.LevelInfo, "session moved to hashed key", "session", hashID(id))
+	}
+	stored := storedSession{data: []byte(data)}
+	if pairs, ok := list[2].([]interface{}); ok && len(pairs) > 0 {
+		stored.fields = make(map[string]string, len(pairs)/2)
+		for i := 0; i+1 < len(pairs); i += 2 {
+			field, _ := pairs[i].(string)
+			stored.fields[field], _ = pairs[i+1].(string)
+		}
+	}
+	return stored, nil
+}
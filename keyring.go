@@ -0,0 +1,384 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package redisbackendhttpsessionstore
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"gopkg.in/redis.v3"
+)
+
+// ErrNoKeys is returned when a key source holds no key.
+var ErrNoKeys = errors.New("SessionStore: key source holds no keys")
+
+// KeyPair is a securecookie authentication key and an optional encryption
+// key.
+type KeyPair struct {
+	Hash  []byte
+	Block []byte
+}
+
+// KeySource supplies the cookie keys, newest first. The first pair signs
+// new cookies, all of them decode.
+//
+// The built-in sources share a text format: one pair per line (or per
+// comma for EnvKeySource), the hash key and the optional block key in
+// base64, separated by a colon. Blank lines and lines starting with # are
+// ignored.
+type KeySource interface {
+	Keys() ([]KeyPair, error)
+}
+
+// FileKeySource reads the keys from a file, e.g. a mounted Kubernetes
+// secret.
+type FileKeySource string
+
+func (f FileKeySource) Keys() ([]KeyPair, error) {
+	data, err := os.ReadFile(string(f))
+	if err != nil {
+		return nil, err
+	}
+	return ParseKeys(string(data))
+}
+
+// EnvKeySource reads the keys from an environment variable, pairs
+// separated by commas.
+type EnvKeySource string
+
+func (e EnvKeySource) Keys() ([]KeyPair, error) {
+	return ParseKeys(strings.Replace(os.Getenv(string(e)), ",", "\n", -1))
+}
+
+// RedisKeySource reads the keys from a Redis list shared by all instances,
+// see ScheduleKeyRotation. A pair staged by the rotation is read after the
+// list, so it decodes before it signs.
+type RedisKeySource struct {
+	Client *redis.Client
+	Key    string
+}
+
+// readKeysScript returns the list KEYS[1] followed by the staged pair
+// KEYS[2], if any, in one step so a promotion is never seen half done.
+const readKeysScript = `
+local list = redis.call('LRANGE', KEYS[1], 0, -1)
+local staged = redis.call('GET', KEYS[2])
+if staged then
+	table.insert(list, staged)
+end
+return list`
+
+func (k RedisKeySource) Keys() ([]KeyPair, error) {
+	reply, err := k.Client.Eval(readKeysScript, []string{k.Key, stagedKey(k.Key)}, nil).Result()
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	if list, ok := reply.([]interface{}); ok {
+		for _, v := range list {
+			if line, ok := v.(string); ok {
+				lines = append(lines, line)
+			}
+		}
+	}
+	return ParseKeys(strings.Join(lines, "\n"))
+}
+
+// ParseKeys parses the text format of the built-in key sources. Block keys
+// must be 16, 24 or 32 bytes long, to select AES-128, AES-192 or AES-256.
+func ParseKeys(text string) ([]KeyPair, error) {
+	var pairs []KeyPair
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		hash, block, _ := strings.Cut(line, ":")
+		var pair KeyPair
+		var err error
+		if pair.Hash, err = base64.StdEncoding.DecodeString(hash); err != nil || len(pair.Hash) == 0 {
+			return nil, fmt.Errorf("SessionStore: invalid hash key in key source: %v", err)
+		}
+		if block != "" {
+			if pair.Block, err = base64.StdEncoding.DecodeString(block); err != nil {
+				return nil, fmt.Errorf("SessionStore: invalid block key in key source: %v", err)
+			}
+			if n := len(pair.Block); n != 16 && n != 24 && n != 32 {
+				return nil, fmt.Errorf("SessionStore: invalid block key in key source: %d bytes, want 16, 24 or 32", n)
+			}
+		}
+		pairs = append(pairs, pair)
+	}
+	if len(pairs) == 0 {
+		return nil, ErrNoKeys
+	}
+	return pairs, nil
+}
+
+// formatKeyPair returns the text format of pair.
+func formatKeyPair(pair KeyPair) string {
+	line := base64.StdEncoding.EncodeToString(pair.Hash)
+	if pair.Block != nil {
+		line += ":" + base64.StdEncoding.EncodeToString(pair.Block)
+	}
+	return line
+}
+
+// keyPairsOf groups keys given in pairs, as to NewSentinelFailoverStore.
+func keyPairsOf(keys [][]byte) []KeyPair {
+	var pairs []KeyPair
+	for i := 0; i < len(keys); i += 2 {
+		pair := KeyPair{Hash: keys[i]}
+		if i+1 < len(keys) {
+			pair.Block = keys[i+1]
+		}
+		pairs = append(pairs, pair)
+	}
+	return pairs
+}
+
+// SetKeys replaces the cookie keys, newest first. Cookies signed with a key
+// that is no longer in the list stop decoding.
+func (s *SentinelFailoverStore) SetKeys(pairs ...KeyPair) {
+	s.setCodecs(pairs, codecsOf(pairs))
+}
+
+func (s *SentinelFailoverStore) setCodecs(pairs []KeyPair, codecs []securecookie.Codec) {
+	s.keysMu.Lock()
+	defer s.keysMu.Unlock()
+	s.Codecs = codecs
+	s.keyPairs = pairs
+	s.configureCodecs()
+}
+
+// codecsOf returns the codecs of pairs.
+func codecsOf(pairs []KeyPair) []securecookie.Codec {
+	var keys [][]byte
+	for _, pair := range pairs {
+		keys = append(keys, pair.Hash, pair.Block)
+	}
+	return securecookie.CodecsFromPairs(keys...)
+}
+
+// ReloadKeys replaces the cookie keys with those of source. Keys the codecs
+// refuse, e.g. a block key of the wrong length, fail the reload and keep
+// the current keys: securecookie would only report them on every Encode
+// and Decode.
+func (s *SentinelFailoverStore) ReloadKeys(source KeySource) error {
+	pairs, err := source.Keys()
+	if err != nil {
+		return err
+	}
+	codecs := codecsOf(pairs)
+	for _, codec := range codecs {
+		if _, err := codec.Encode("keycheck", "keycheck"); err != nil {
+			return fmt.Errorf("SessionStore: invalid keys in key source: %w", err)
+		}
+	}
+	s.setCodecs(pairs, codecs)
+	return nil
+}
+
+// WatchKeys loads the keys from source at once, then reloads them every
+// interval until the store is closed. Failed loads are logged and keep the
+// current keys.
+func (s *SentinelFailoverStore) WatchKeys(source KeySource, interval time.Duration) {
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	if err := s.ReloadKeys(source); err != nil {
+		s.logger.Log(context.Background(), slog.LevelWarn, "cookie keys could not be loaded",
+			"error", err)
+	}
+	s.goBackground(func(done <-chan struct{}) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := s.ReloadKeys(source); err != nil {
+					s.logger.Log(context.Background(), slog.LevelWarn, "cookie keys could not be reloaded",
+						"error", err)
+				}
+			}
+		}
+	})
+}
+
+// KeyRotationConfig configures ScheduleKeyRotation.
+type KeyRotationConfig struct {
+	// Key is the Redis list holding the pairs, read by a RedisKeySource
+	// on the same key.
+	Key string
+	// Interval between two rotations, 24 hours by default.
+	Interval time.Duration
+	// Keep is the number of pairs kept in the list, at least 2, so a
+	// cookie decodes for Keep intervals after it was signed.
+	Keep int
+	// Stage is how long a new pair only decodes before it signs. It must
+	// exceed the WatchKeys interval of every instance, so all of them know
+	// the pair before the first cookie signed with it arrives. 2 minutes
+	// by default, and never more than Interval.
+	Stage time.Duration
+}
+
+// seedKeysScript fills the empty list KEYS[1] with the pairs in ARGV.
+const seedKeysScript = `
+if redis.call('EXISTS', KEYS[1]) == 1 then
+	return 0
+end
+redis.call('RPUSH', KEYS[1], unpack(ARGV))
+return 1`
+
+// keyRotationScript stages a new pair, and once the rotation is due
+// promotes the staged pair to signer, retires the oldest pairs and stages
+// the next one.
+//
+// KEYS[1] is the list, KEYS[2] the rotation marker and KEYS[3] the staged
+// pair. ARGV[1] is a fresh pair, ARGV[2] the interval and ARGV[3] the stage
+// delay in milliseconds, ARGV[4] the number of pairs kept.
+const keyRotationScript = `
+local staged = redis.call('GET', KEYS[3])
+if not staged then
+	redis.call('SET', KEYS[3], ARGV[1])
+	redis.call('SET', KEYS[2], '1', 'PX', ARGV[3])
+	return 1
+end
+if redis.call('EXISTS', KEYS[2]) == 1 then
+	return 0
+end
+redis.call('LPUSH', KEYS[1], staged)
+redis.call('LTRIM', KEYS[1], 0, tonumber(ARGV[4]) - 1)
+redis.call('SET', KEYS[3], ARGV[1])
+redis.call('SET', KEYS[2], '1', 'PX', ARGV[2])
+return 2`
+
+// stagedKey returns the key of the pair staged for the list key.
+func stagedKey(key string) string {
+	return key + "_staged"
+}
+
+// ScheduleKeyRotation rotates the cookie keys in a Redis list every
+// config.Interval. Every instance may call it, a marker key makes sure
+// only one of them rotates per interval. Instances pick the keys up
+// through WatchKeys with a RedisKeySource on the same key.
+//
+// An empty list is first seeded with the current keys of the store, so
+// cookies signed before rotation was turned on keep decoding. Each new
+// pair is staged, decoding only, for config.Stage before it becomes the
+// signing pair.
+func (s *SentinelFailoverStore) ScheduleKeyRotation(config KeyRotationConfig) {
+	if config.Keep < 2 {
+		config.Keep = 2
+	}
+	if config.Interval <= 0 {
+		config.Interval = 24 * time.Hour
+	}
+	if config.Stage <= 0 {
+		config.Stage = 2 * time.Minute
+	}
+	if config.Stage > config.Interval {
+		config.Stage = config.Interval
+	}
+	seeded := false
+	rotate := func() {
+		if !seeded {
+			if err := s.seedKeys(config.Key); err != nil {
+				s.logger.Log(context.Background(), slog.LevelWarn, "cookie keys could not be seeded",
+					"error", err)
+				return
+			}
+			seeded = true
+		}
+		pair := KeyPair{
+			Hash:  securecookie.GenerateRandomKey(64),
+			Block: securecookie.GenerateRandomKey(32),
+		}
+		err := s.FailoverClient.Eval(keyRotationScript,
+			[]string{config.Key, config.Key + "_rotated", stagedKey(config.Key)}, []string{
+				formatKeyPair(pair),
+				fmt.Sprint(int64(config.Interval / time.Millisecond)),
+				fmt.Sprint(int64(config.Stage / time.Millisecond)),
+				fmt.Sprint(config.Keep),
+			}).Err()
+		if err != nil {
+			s.logger.Log(context.Background(), slog.LevelWarn, "cookie keys could not be rotated",
+				"error", err)
+		}
+	}
+	s.goBackground(func(done <-chan struct{}) {
+		// Check well within the stage delay, so a rotation missed by an
+		// instance that stopped is made up by another one soon.
+		check := config.Stage / 4
+		if check > time.Minute {
+			check = time.Minute
+		} else if check < time.Second {
+			check = time.Second
+		}
+		rotate()
+		ticker := time.NewTicker(check)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				rotate()
+			}
+		}
+	})
+}
+
+// seedKeys writes the current keys to the list key unless it holds some.
+func (s *SentinelFailoverStore) seedKeys(key string) error {
+	s.keysMu.RLock()
+	var lines []string
+	for _, pair := range s.keyPairs {
+		lines = append(lines, formatKeyPair(pair))
+	}
+	s.keysMu.RUnlock()
+	if len(lines) == 0 {
+		return nil
+	}
+	return s.FailoverClient.Eval(seedKeysScript, []string{key}, lines).Err()
+}
+
+// codecs returns the current cookie codecs.
+func (s *SentinelFailoverStore) codecs() []securecookie.Codec {
+	s.keysMu.RLock()
+	defer s.keysMu.RUnlock()
+	return s.Codecs
+}
+
+// configureCodecs applies the cookie settings of the store to its codecs.
+// The caller holds keysMu.
+func (s *SentinelFailoverStore) configureCodecs() {
+	for _, c := range s.Codecs {
+		if codec, ok := c.(*securecookie.SecureCookie); ok {
+			codec.MaxAge(s.Options.MaxAge)
+			if s.cookieMaxLength != nil {
+				codec.MaxLength(*s.cookieMaxLength)
+			}
+		}
+	}
+}
@@ -0,0 +1,89 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package redisbackendhttpsessionstore
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// LazySession is a handle on a session whose cookie is decoded right away
+// but whose Redis load is deferred until Session is called, so handlers
+// that end up not needing the session do not pay for it.
+//
+// The load goes through the request's sessions.Registry, so the session
+// returned is the one store.Get and sessions.Save see for the same request.
+type LazySession struct {
+	store *SentinelFailoverStore
+	r     *http.Request
+	name  string
+	id    string
+
+	once    sync.Once
+	loaded  bool
+	session *sessions.Session
+	err     error
+}
+
+// Lazy returns a lazy handle on the named session of r.
+func (s *SentinelFailoverStore) Lazy(r *http.Request, name string) *LazySession {
+	l := &LazySession{store: s, r: r, name: name}
+	// Bind the registry to r now, so requests derived from it later share
+	// the session.
+	sessions.GetRegistry(r)
+	if value, _, ok := s.readSession(r, name); ok {
+		if securecookie.DecodeMulti(name, value, &l.id, s.codecs()...) != nil || !s.validID(l.id) {
+			l.id = ""
+		}
+	}
+	return l
+}
+
+// ID returns the session ID carried by the request without loading the
+// session, or "" when there is no valid one. A non-empty ID does not
+// mean the session still exists in Redis.
+func (l *LazySession) ID() string {
+	return l.id
+}
+
+// Name returns the session name.
+func (l *LazySession) Name() string {
+	return l.name
+}
+
+// Loaded reports whether Session has been called.
+func (l *LazySession) Loaded() bool {
+	return l.loaded
+}
+
+// Session loads the session on first use and returns it, with the error of
+// that load on every call.
+func (l *LazySession) Session() (*sessions.Session, error) {
+	l.once.Do(func() {
+		l.loaded = true
+		l.session, l.err = sessions.GetRegistry(l.r).Get(l.store, l.name)
+	})
+	return l.session, l.err
+}
+
+// Save saves the session if it was loaded, and does nothing otherwise.
+func (l *LazySession) Save(w http.ResponseWriter) error {
+	if !l.loaded || l.session == nil {
+		return nil
+	}
+	return l.store.Save(l.r, w, l.session)
+}
@@ -0,0 +1,208 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package redisbackendhttpsessionstore
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/securecookie"
+)
+
+var (
+	// ErrLockHeld is returned by TryLockSession when another holder has the
+	// lock.
+	ErrLockHeld = errors.New("SessionStore: session lock held by another request")
+	// ErrLockTimeout is returned by LockSession when the lock could not be
+	// obtained before the context was done.
+	ErrLockTimeout = errors.New("SessionStore: timed out waiting for session lock")
+	// ErrLockNotHeld is returned by Unlock and Extend when the lock expired
+	// and may have been taken by someone else.
+	ErrLockNotHeld = errors.New("SessionStore: session lock no longer held")
+)
+
+// lockScript takes the lock and returns a new fencing token, or 0.
+//
+// KEYS[1] is the lock, KEYS[2] the fencing counter. ARGV[1] is the owner
+// and ARGV[2] the TTL in milliseconds.
+const lockScript = `
+if redis.call('SET', KEYS[1], ARGV[1], 'NX', 'PX', ARGV[2]) then
+	return redis.call('INCR', KEYS[2])
+end
+return 0`
+
+// unlockScript deletes the lock only if ARGV[1] still owns it.
+const unlockScript = `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0`
+
+// extendScript resets the TTL only if ARGV[1] still owns the lock.
+const extendScript = `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0`
+
+// SessionLock is a held per-session lock. It expires after its TTL even if
+// the holder dies, so a holder outliving the TTL must not assume it still
+// owns the lock: pass Fence to the protected resource, which rejects
+// writes carrying a lower token than it has already seen.
+type SessionLock struct {
+	store *SentinelFailoverStore
+	key   string
+	owner string
+	// Fence increases with every lock taken through the store.
+	Fence int64
+}
+
+// TryLockSession takes the lock of session id for ttl, or fails at once
+// with ErrLockHeld.
+func (s *SentinelFailoverStore) TryLockSession(id string, ttl time.Duration) (*SessionLock, error) {
+	l := &SessionLock{
+		store: s,
+		key:   s.lockKey(id),
+		owner: hex.EncodeToString(securecookie.GenerateRandomKey(16)),
+	}
+	fence, err := s.FailoverClient.Eval(lockScript, []string{l.key, s.fenceKey()},
+		[]string{l.owner, strconv.FormatInt(int64(ttl/time.Millisecond), 10)}).Result()
+	if err != nil {
+		return nil, err
+	}
+	if l.Fence, _ = fence.(int64); l.Fence == 0 {
+		return nil, ErrLockHeld
+	}
+	return l, nil
+}
+
+// LockSession waits until it takes the lock of session id for ttl, or
+// returns ErrLockTimeout once ctx is done.
+func (s *SentinelFailoverStore) LockSession(ctx context.Context, id string, ttl time.Duration) (*SessionLock, error) {
+	backoff := 10 * time.Millisecond
+	for {
+		l, err := s.TryLockSession(id, ttl)
+		if err != ErrLockHeld {
+			return l, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ErrLockTimeout
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > 200*time.Millisecond {
+			backoff = 200 * time.Millisecond
+		}
+	}
+}
+
+// Unlock releases the lock if it is still held by l.
+func (l *SessionLock) Unlock() error {
+	return l.run(unlockScript)
+}
+
+// Extend resets the TTL of the lock if it is still held by l.
+func (l *SessionLock) Extend(ttl time.Duration) error {
+	return l.run(extendScript, strconv.FormatInt(int64(ttl/time.Millisecond), 10))
+}
+
+func (l *SessionLock) run(script string, args ...string) error {
+	n, err := l.store.FailoverClient.Eval(script, []string{l.key},
+		append([]string{l.owner}, args...)).Result()
+	if err != nil {
+		return err
+	}
+	if n, _ := n.(int64); n == 0 {
+		return ErrLockNotHeld
+	}
+	return nil
+}
+
+// LockConfig configures LockMiddleware.
+type LockConfig struct {
+	// TTL bounds how long a request holds the lock, 30 seconds by default.
+	TTL time.Duration
+	// Timeout bounds how long a request waits for the lock, 10 seconds by
+	// default.
+	Timeout time.Duration
+	// ErrorHandler serves requests that did not get the lock. By default
+	// they get a 409 Conflict when the wait timed out and a 500 otherwise.
+	ErrorHandler func(w http.ResponseWriter, r *http.Request, err error)
+}
+
+type lockContextKey struct{}
+
+// LockMiddleware serializes the requests of each session of the given
+// name across all instances. Requests without a session cookie are not
+// locked. The session ID is read from the cookie, the session itself is
+// not loaded.
+func (s *SentinelFailoverStore) LockMiddleware(name string, config LockConfig) func(http.Handler) http.Handler {
+	if config.TTL <= 0 {
+		config.TTL = 30 * time.Second
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 10 * time.Second
+	}
+	if config.ErrorHandler == nil {
+		config.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+			if err == ErrLockTimeout {
+				http.Error(w, "session is busy with another request", http.StatusConflict)
+				return
+			}
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := s.Lazy(r, name).ID()
+			if id == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			ctx, cancel := context.WithTimeout(r.Context(), config.Timeout)
+			l, err := s.LockSession(ctx, id, config.TTL)
+			cancel()
+			if err != nil {
+				s.logError(r.Context(), OpLoad, id, "session lock not acquired", err)
+				config.ErrorHandler(w, r, err)
+				return
+			}
+			defer l.Unlock()
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), lockContextKey{}, l)))
+		})
+	}
+}
+
+// LockFromContext returns the lock held by LockMiddleware for the request,
+// e.g. to pass its Fence along, or nil.
+func LockFromContext(ctx context.Context) *SessionLock {
+	l, _ := ctx.Value(lockContextKey{}).(*SessionLock)
+	return l
+}
+
+// lockKey returns the key of the lock of a session, outside the session
+// prefix.
+func (s *SentinelFailoverStore) lockKey(id string) string {
+	return "lock_" + s.keyPrefix + s.storageID(id)
+}
+
+// fenceKey returns the key of the fencing counter shared by all locks. It
+// never expires, so tokens keep increasing across lock expirations.
+func (s *SentinelFailoverStore) fenceKey() string {
+	return "fence_" + s.keyPrefix
+}
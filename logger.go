@@ -0,0 +1,84 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package redisbackendhttpsessionstore
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+)
+
+// Logger receives structured events from the store. args are alternating
+// keys and values as in log/slog, so a *slog.Logger can be used directly:
+//
+//	store.SetLogger(slog.Default())
+//
+// Session IDs are never logged, only the first bytes of their SHA-256 hash
+// under the "session" key.
+type Logger interface {
+	Log(ctx context.Context, level slog.Level, msg string, args ...interface{})
+}
+
+// nopLogger discards every event.
+type nopLogger struct{}
+
+func (nopLogger) Log(context.Context, slog.Level, string, ...interface{}) {}
+
+// SetLogger sets the logger of the store. Passing nil silences the store,
+// which is also the default. It is safe to call while the store is in use.
+func (s *SentinelFailoverStore) SetLogger(l Logger) {
+	if l == nil {
+		l = nopLogger{}
+	}
+	s.logger.l.Store(&l)
+}
+
+// syncLogger is the logger of the store, replaced by SetLogger while the
+// background goroutines of the store log through it.
+type syncLogger struct {
+	l atomic.Pointer[Logger]
+}
+
+func (s *syncLogger) Log(ctx context.Context, level slog.Level, msg string, args ...interface{}) {
+	if l := s.l.Load(); l != nil {
+		(*l).Log(ctx, level, msg, args...)
+	}
+}
+
+// hashID returns a short digest of a session ID that is safe to log and
+// still allows correlating events of the same session.
+func hashID(id string) string {
+	if id == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:8])
+}
+
+// requestContext returns the context of r, which may be nil.
+func requestContext(r *http.Request) context.Context {
+	if r == nil {
+		return context.Background()
+	}
+	return r.Context()
+}
+
+// logError reports a failed store operation on a session.
+func (s *SentinelFailoverStore) logError(ctx context.Context, op, id, msg string, err error, args ...interface{}) {
+	args = append([]interface{}{"op", op, "session", hashID(id), "error", err}, args...)
+	s.logger.Log(ctx, slog.LevelWarn, msg, args...)
+}
@@ -0,0 +1,181 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package redisbackendhttpsessionstore
+
+import (
+	"expvar"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Store operations reported to Metrics.
+const (
+	OpLoad   = "load"
+	OpSave   = "save"
+	OpDelete = "delete"
+)
+
+// Error kinds reported to Metrics.
+const (
+	ErrKindCookie      = "cookie"
+	ErrKindSerialize   = "serialize"
+	ErrKindDeserialize = "deserialize"
+	ErrKindRedis       = "redis"
+	ErrKindTooBig      = "too_big"
+	// ErrKindRejected and ErrKindReauthenticate report sessions refused
+	// by a validator, see ValidationOutcome.
+	ErrKindRejected       = "validation_reject"
+	ErrKindReauthenticate = "validation_reauthenticate"
+	// ErrKindFingerprint reports a session presented by a client whose
+	// fingerprint differs from the bound one, see BindSessions.
+	ErrKindFingerprint = "fingerprint_mismatch"
+	// ErrKindTheft reports a replayed remember-me token, see RememberMe.
+	ErrKindTheft = "remember_me_theft"
+	// ErrKindField reports an atomic field operation on an incompatible
+	// value, see SessionFields.
+	ErrKindField = "field_value"
+)
+
+// Metrics receives instrumentation events from a SentinelFailoverStore.
+//
+// Implementations must be safe for concurrent use. The store calls them
+// synchronously, so they should not block.
+type Metrics interface {
+	// Load is called after a session key was read. hit is false when the
+	// key did not exist; size and decode are zero in that case.
+	Load(hit bool, size int, decode time.Duration)
+	// Save is called after a session was written to Redis.
+	Save(size int, encode time.Duration)
+	// Delete is called after a session key was removed.
+	Delete()
+	// Redis is called with the round trip time of every Redis command.
+	Redis(op string, latency time.Duration)
+	// Error is called when op fails, kind is one of the ErrKind constants.
+	Error(op, kind string)
+	// TooBig is called when a session exceeds the store's maximum length.
+	TooBig(size, limit int)
+	// Chunked is called when a session too big for one key was saved in
+	// chunks, see EnableChunking.
+	Chunked(size, chunks int)
+}
+
+// ExpvarMetrics is a Metrics implementation publishing counters through
+// the expvar package, i.e. on /debug/vars.
+type ExpvarMetrics struct {
+	m *expvar.Map
+}
+
+// NewExpvarMetrics publishes a new expvar map with the given name. Like
+// expvar.Publish it panics if the name is already in use.
+func NewExpvarMetrics(name string) *ExpvarMetrics {
+	return &ExpvarMetrics{m: expvar.NewMap(name)}
+}
+
+var (
+	defaultMetricsOnce sync.Once
+	defaultMetrics     *ExpvarMetrics
+)
+
+// DefaultMetrics returns the expvar metrics shared by all stores that were
+// not given their own implementation. It is published as
+// "redisbackendhttpsessionstore".
+func DefaultMetrics() *ExpvarMetrics {
+	defaultMetricsOnce.Do(func() {
+		defaultMetrics = NewExpvarMetrics("redisbackendhttpsessionstore")
+	})
+	return defaultMetrics
+}
+
+func (e *ExpvarMetrics) Load(hit bool, size int, decode time.Duration) {
+	if !hit {
+		e.m.Add("load_misses", 1)
+		return
+	}
+	e.m.Add("load_hits", 1)
+	e.m.Add("load_bytes", int64(size))
+	e.m.Add("deserialize_ns", int64(decode))
+}
+
+func (e *ExpvarMetrics) Save(size int, encode time.Duration) {
+	e.m.Add("saves", 1)
+	e.m.Add("save_bytes", int64(size))
+	e.m.Add("serialize_ns", int64(encode))
+}
+
+func (e *ExpvarMetrics) Delete() {
+	e.m.Add("deletes", 1)
+}
+
+func (e *ExpvarMetrics) Redis(op string, latency time.Duration) {
+	e.m.Add("redis_calls."+op, 1)
+	e.m.Add("redis_ns."+op, int64(latency))
+}
+
+func (e *ExpvarMetrics) Error(op, kind string) {
+	e.m.Add("errors."+op+"."+kind, 1)
+}
+
+func (e *ExpvarMetrics) TooBig(size, limit int) {
+	e.m.Add("too_big", 1)
+}
+
+func (e *ExpvarMetrics) Chunked(size, chunks int) {
+	e.m.Add("chunked_saves", 1)
+	e.m.Add("chunks", int64(chunks))
+}
+
+// nopMetrics discards every event.
+type nopMetrics struct{}
+
+func (nopMetrics) Load(bool, int, time.Duration) {}
+func (nopMetrics) Save(int, time.Duration)       {}
+func (nopMetrics) Delete()                       {}
+func (nopMetrics) Redis(string, time.Duration)   {}
+func (nopMetrics) Error(string, string)          {}
+func (nopMetrics) TooBig(int, int)               {}
+func (nopMetrics) Chunked(int, int)              {}
+
+// SetMetrics sets the instrumentation hook of the store. Passing nil turns
+// instrumentation off. The default for a new SentinelFailoverStore is
+// DefaultMetrics(). It is safe to call while the store is in use.
+func (s *SentinelFailoverStore) SetMetrics(m Metrics) {
+	if m == nil {
+		m = nopMetrics{}
+	}
+	s.metrics.m.Store(&m)
+}
+
+// syncMetrics is the instrumentation hook of the store, replaced by
+// SetMetrics while requests and background goroutines report to it.
+type syncMetrics struct {
+	m atomic.Pointer[Metrics]
+}
+
+func (s *syncMetrics) get() Metrics {
+	if m := s.m.Load(); m != nil {
+		return *m
+	}
+	return nopMetrics{}
+}
+
+func (s *syncMetrics) Load(hit bool, size int, decode time.Duration) {
+	s.get().Load(hit, size, decode)
+}
+func (s *syncMetrics) Save(size int, encode time.Duration)    { s.get().Save(size, encode) }
+func (s *syncMetrics) Delete()                                { s.get().Delete() }
+func (s *syncMetrics) Redis(op string, latency time.Duration) { s.get().Redis(op, latency) }
+func (s *syncMetrics) Error(op, kind string)                  { s.get().Error(op, kind) }
+func (s *syncMetrics) TooBig(size, limit int)                 { s.get().TooBig(size, limit) }
+func (s *syncMetrics) Chunked(size, chunks int)               { s.get().Chunked(size, chunks) }
@@ -0,0 +1,249 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package redisbackendhttpsessionstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"net/http"
+	"reflect"
+	"sync"
+
+	"github.com/gorilla/sessions"
+)
+
+// MiddlewareOptions configures Middleware.
+type MiddlewareOptions struct {
+	// ErrorHandler serves requests whose session could not be loaded, or
+	// saved before the response started. It defaults to a plain 500.
+	// A bad or missing cookie is not a load error, the handler gets a
+	// fresh session; a *ValidationError is one.
+	ErrorHandler func(w http.ResponseWriter, r *http.Request, err error)
+	// Lazy defers loading the session until FromContext is first called.
+	// Sessions never loaded, or first loaded after the response started,
+	// are not saved, and load errors are not reported to ErrorHandler:
+	// FromContext returns whatever the store returned, which may be nil,
+	// and ErrorFromContext the error.
+	Lazy bool
+}
+
+type contextKey struct{ name string }
+
+// defaultContextKey holds the session of the innermost Middleware.
+var defaultContextKey = contextKey{}
+
+// autoSession tracks a session loaded by Middleware.
+type autoSession struct {
+	load     func() (*sessions.Session, error)
+	once     sync.Once
+	loaded   bool
+	session  *sessions.Session
+	err      error
+	snapshot []byte
+	options  sessions.Options
+	saved    bool
+}
+
+// get loads the session on first use. A cookie error only means the
+// session is fresh, so it is not kept.
+func (a *autoSession) get() (*sessions.Session, error) {
+	a.once.Do(func() {
+		a.loaded = true
+		a.session, a.err = a.load()
+		if IsCookieError(a.err) {
+			a.err = nil
+		}
+		if a.session != nil {
+			a.options = *a.session.Options
+			a.snapshot, _ = snapshotValues(a.session.Values)
+		}
+	})
+	return a.session, a.err
+}
+
+// Middleware loads the named session once per request and puts it in the
+// request context, see FromContext. The session is saved right before the
+// response headers are written, or when the handler returns without
+// writing, but only if its values or options were modified. A session
+// whose load failed is never saved, so an empty session handed out after
+// e.g. a Redis error cannot overwrite the stored one.
+//
+// Values are compared against a gob snapshot taken at load time, so every
+// type stored in a session must be registered with gob, as the default
+// serializer requires anyway. Sessions that cannot be snapshotted are
+// always saved.
+//
+// The session is taken from the request's sessions.Registry, so store.Get
+// in handlers returns the same session.
+func Middleware(store sessions.Store, name string, opts MiddlewareOptions) func(http.Handler) http.Handler {
+	if opts.ErrorHandler == nil {
+		opts.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Bind the registry before the request is copied below.
+			sessions.GetRegistry(r)
+			state := &autoSession{load: func() (*sessions.Session, error) {
+				return store.Get(r, name)
+			}}
+			if !opts.Lazy {
+				if session, err := state.get(); err != nil || session == nil {
+					opts.ErrorHandler(w, r, err)
+					return
+				}
+			}
+
+			ctx := context.WithValue(r.Context(), contextKey{name}, state)
+			ctx = context.WithValue(ctx, defaultContextKey, state)
+			r = r.WithContext(ctx)
+
+			sw := &sessionWriter{ResponseWriter: w, r: r, state: state, onError: opts.ErrorHandler}
+			next.ServeHTTP(sw, r)
+			sw.saveOnce()
+		})
+	}
+}
+
+// FromContext returns the session loaded by the innermost Middleware, or
+// nil outside of one. In Lazy mode the first call loads the session.
+func FromContext(ctx context.Context) *sessions.Session {
+	return sessionFromContext(ctx, defaultContextKey)
+}
+
+// NamedFromContext returns the named session loaded by Middleware, for
+// handlers wrapped in several of them.
+func NamedFromContext(ctx context.Context, name string) *sessions.Session {
+	return sessionFromContext(ctx, contextKey{name})
+}
+
+// ValueFromContext returns the value of key in the session of the innermost
+// Middleware, if present and of type T.
+func ValueFromContext[T any](ctx context.Context, key interface{}) (T, bool) {
+	var zero T
+	session := FromContext(ctx)
+	if session == nil {
+		return zero, false
+	}
+	v, ok := session.Values[key].(T)
+	return v, ok
+}
+
+// ErrorFromContext returns the error loading the session of the innermost
+// Middleware, nil for a bad or missing cookie. In Lazy mode the first call
+// loads the session.
+func ErrorFromContext(ctx context.Context) error {
+	return errorFromContext(ctx, defaultContextKey)
+}
+
+// NamedErrorFromContext is ErrorFromContext for the named session.
+func NamedErrorFromContext(ctx context.Context, name string) error {
+	return errorFromContext(ctx, contextKey{name})
+}
+
+func sessionFromContext(ctx context.Context, key contextKey) *sessions.Session {
+	if state, ok := ctx.Value(key).(*autoSession); ok {
+		session, _ := state.get()
+		return session
+	}
+	return nil
+}
+
+func errorFromContext(ctx context.Context, key contextKey) error {
+	if state, ok := ctx.Value(key).(*autoSession); ok {
+		_, err := state.get()
+		return err
+	}
+	return nil
+}
+
+// modified reports whether the session differs from its load time state.
+func (a *autoSession) modified() bool {
+	if a.snapshot == nil || *a.session.Options != a.options {
+		return true
+	}
+	var before map[interface{}]interface{}
+	if err := gob.NewDecoder(bytes.NewReader(a.snapshot)).Decode(&before); err != nil {
+		return true
+	}
+	if len(before) == 0 && len(a.session.Values) == 0 {
+		return false
+	}
+	return !reflect.DeepEqual(before, a.session.Values)
+}
+
+func snapshotValues(values map[interface{}]interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(values); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// sessionWriter saves the session before the first header or body byte
+// reaches the client. If the save fails, the error handler responds and
+// the output of the handler is discarded.
+type sessionWriter struct {
+	http.ResponseWriter
+	r       *http.Request
+	state   *autoSession
+	onError func(w http.ResponseWriter, r *http.Request, err error)
+	failed  bool
+}
+
+func (w *sessionWriter) saveOnce() {
+	state := w.state
+	if state.saved {
+		return
+	}
+	state.saved = true
+	if !state.loaded || state.err != nil || state.session == nil || !state.modified() {
+		return
+	}
+	if err := state.session.Save(w.r, w.ResponseWriter); err != nil {
+		w.failed = true
+		w.onError(w.ResponseWriter, w.r, err)
+	}
+}
+
+func (w *sessionWriter) WriteHeader(code int) {
+	w.saveOnce()
+	if w.failed {
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *sessionWriter) Write(b []byte) (int, error) {
+	w.saveOnce()
+	if w.failed {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush implements http.Flusher when the underlying writer does.
+func (w *sessionWriter) Flush() {
+	w.saveOnce()
+	if f, ok := w.ResponseWriter.(http.Flusher); ok && !w.failed {
+		f.Flush()
+	}
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer.
+func (w *sessionWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,181 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package prommetrics exposes the session store instrumentation as a
+// Prometheus collector. It lives in its own package so that users of the
+// store do not pull in the Prometheus client unless they ask for it.
+//
+//	collector := prommetrics.New("checkout")
+//	prometheus.MustRegister(collector)
+//	store.SetMetrics(collector)
+package prommetrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "http_session"
+
+// Collector implements both redisbackendhttpsessionstore.Metrics and
+// prometheus.Collector.
+type Collector struct {
+	loads         *prometheus.CounterVec
+	saves         prometheus.Counter
+	deletes       prometheus.Counter
+	tooBig        prometheus.Counter
+	chunked       prometheus.Counter
+	chunks        prometheus.Histogram
+	errors        *prometheus.CounterVec
+	payload       *prometheus.HistogramVec
+	serialization *prometheus.HistogramVec
+	redis         *prometheus.HistogramVec
+}
+
+// New returns a collector whose series carry a constant "service" label,
+// so several services can share one dashboard.
+func New(service string) *Collector {
+	labels := prometheus.Labels{"service": service}
+	return &Collector{
+		loads: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        "loads_total",
+			Help:        "Session loads from Redis by result (hit or miss).",
+			ConstLabels: labels,
+		}, []string{"result"}),
+		saves: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        "saves_total",
+			Help:        "Sessions written to Redis.",
+			ConstLabels: labels,
+		}),
+		deletes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        "deletes_total",
+			Help:        "Sessions deleted from Redis.",
+			ConstLabels: labels,
+		}),
+		tooBig: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        "too_big_total",
+			Help:        "Sessions rejected for exceeding the maximum length.",
+			ConstLabels: labels,
+		}),
+		chunked: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        "chunked_saves_total",
+			Help:        "Sessions saved in chunks for exceeding the maximum length.",
+			ConstLabels: labels,
+		}),
+		chunks: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace:   namespace,
+			Name:        "chunks",
+			Help:        "Number of chunks of sessions saved in chunks.",
+			ConstLabels: labels,
+			Buckets:     prometheus.LinearBuckets(2, 2, 8),
+		}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        "errors_total",
+			Help:        "Store errors by operation and kind.",
+			ConstLabels: labels,
+		}, []string{"op", "kind"}),
+		payload: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace:   namespace,
+			Name:        "payload_bytes",
+			Help:        "Size of serialized sessions.",
+			ConstLabels: labels,
+			Buckets:     prometheus.ExponentialBuckets(64, 2, 12),
+		}, []string{"op"}),
+		serialization: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace:   namespace,
+			Name:        "serialization_seconds",
+			Help:        "Time spent serializing and deserializing sessions.",
+			ConstLabels: labels,
+			Buckets:     prometheus.ExponentialBuckets(0.00001, 4, 8),
+		}, []string{"op"}),
+		redis: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace:   namespace,
+			Name:        "redis_seconds",
+			Help:        "Round trip time of Redis commands.",
+			ConstLabels: labels,
+			Buckets:     prometheus.DefBuckets,
+		}, []string{"op"}),
+	}
+}
+
+func (c *Collector) Load(hit bool, size int, decode time.Duration) {
+	if !hit {
+		c.loads.WithLabelValues("miss").Inc()
+		return
+	}
+	c.loads.WithLabelValues("hit").Inc()
+	c.payload.WithLabelValues("load").Observe(float64(size))
+	c.serialization.WithLabelValues("load").Observe(decode.Seconds())
+}
+
+func (c *Collector) Save(size int, encode time.Duration) {
+	c.saves.Inc()
+	c.payload.WithLabelValues("save").Observe(float64(size))
+	c.serialization.WithLabelValues("save").Observe(encode.Seconds())
+}
+
+func (c *Collector) Delete() {
+	c.deletes.Inc()
+}
+
+func (c *Collector) Redis(op string, latency time.Duration) {
+	c.redis.WithLabelValues(op).Observe(latency.Seconds())
+}
+
+func (c *Collector) Error(op, kind string) {
+	c.errors.WithLabelValues(op, kind).Inc()
+}
+
+func (c *Collector) TooBig(size, limit int) {
+	c.tooBig.Inc()
+}
+
+func (c *Collector) Chunked(size, chunks int) {
+	c.chunked.Inc()
+	c.chunks.Observe(float64(chunks))
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	c.loads.Describe(ch)
+	c.saves.Describe(ch)
+	c.deletes.Describe(ch)
+	c.tooBig.Describe(ch)
+	c.chunked.Describe(ch)
+	c.chunks.Describe(ch)
+	c.errors.Describe(ch)
+	c.payload.Describe(ch)
+	c.serialization.Describe(ch)
+	c.redis.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.loads.Collect(ch)
+	c.saves.Collect(ch)
+	c.deletes.Collect(ch)
+	c.tooBig.Collect(ch)
+	c.chunked.Collect(ch)
+	c.chunks.Collect(ch)
+	c.errors.Collect(ch)
+	c.payload.Collect(ch)
+	c.serialization.Collect(ch)
+	c.redis.Collect(ch)
+}
@@ -0,0 +1,105 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ratelimit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/sessions"
+	redisbackendhttpsessionstore "github.com/stackdocker/http-session-redis-sentinel-backend"
+)
+
+// KeyFunc returns the key a request is counted under. Returning false
+// exempts the request from limiting.
+type KeyFunc func(r *http.Request) (string, bool)
+
+// KeyByIP counts requests per client IP. Forwarding headers are only
+// believed from proxies, which may be nil.
+func KeyByIP(proxies redisbackendhttpsessionstore.TrustedProxies) KeyFunc {
+	return func(r *http.Request) (string, bool) {
+		ip := proxies.ClientIP(r)
+		if ip == nil {
+			return "", false
+		}
+		return "ip:" + ip.String(), true
+	}
+}
+
+// KeyByUser counts requests per user name, as returned by user. Requests
+// without a user are not limited.
+func KeyByUser(user func(r *http.Request) string) KeyFunc {
+	return func(r *http.Request) (string, bool) {
+		name := user(r)
+		if name == "" {
+			return "", false
+		}
+		return "user:" + name, true
+	}
+}
+
+// KeyBySession counts requests per session ID of the named session. The
+// ID is hashed, so the counter keys cannot be replayed as cookies.
+// Requests without a stored session are not limited, combine with KeyByIP
+// to cover them.
+func KeyBySession(store sessions.Store, name string) KeyFunc {
+	return func(r *http.Request) (string, bool) {
+		session, err := store.Get(r, name)
+		if err != nil || session.ID == "" {
+			return "", false
+		}
+		sum := sha256.Sum256([]byte(session.ID))
+		return "session:" + hex.EncodeToString(sum[:16]), true
+	}
+}
+
+// Middleware limits requests to next. Denied requests get a 429 response
+// with a Retry-After header; every limited response carries
+// X-RateLimit-Limit and X-RateLimit-Remaining.
+//
+// When Redis cannot be reached the middleware fails open and lets requests
+// through, or denies them with a 429 if Config.FailClosed is set. Either
+// way the error is logged to Config.Logger.
+func (l *Limiter) Middleware(key KeyFunc) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			k, ok := key(r)
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+			result, err := l.Allow(k)
+			if err != nil && l.config.Logger != nil {
+				l.config.Logger.Log(r.Context(), slog.LevelWarn, "rate limit could not be checked",
+					"error", err, "fail_closed", l.config.FailClosed)
+			}
+			w.Header().Set("X-RateLimit-Limit", strconv.FormatInt(result.Limit, 10))
+			w.Header().Set("X-RateLimit-Remaining", strconv.FormatInt(result.Remaining, 10))
+			if !result.Allowed {
+				retry := int64(math.Ceil(result.RetryAfter.Seconds()))
+				if retry < 1 {
+					retry = 1
+				}
+				w.Header().Set("Retry-After", strconv.FormatInt(retry, 10))
+				http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,205 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package ratelimit implements distributed rate limiting on top of the
+// Redis client of a SentinelFailoverStore, so all instances of a service
+// share their counters without a second Redis client stack:
+//
+//	limiter := ratelimit.New(store.FailoverClient, ratelimit.Config{
+//		Algorithm: ratelimit.SlidingLog,
+//		Limit:     5,
+//		Window:    time.Minute,
+//	})
+//	http.Handle("/signin/", limiter.Middleware(ratelimit.KeyByIP(nil))(signin))
+//
+// Every algorithm runs as a single Lua script, so a decision is atomic
+// across instances, and time is taken from the Redis server to avoid clock
+// skew between them.
+package ratelimit
+
+import (
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	redisbackendhttpsessionstore "github.com/stackdocker/http-session-redis-sentinel-backend"
+	"gopkg.in/redis.v3"
+)
+
+// Algorithm selects how requests are counted.
+type Algorithm int
+
+const (
+	// FixedWindow counts requests in consecutive windows. It is the
+	// cheapest, but allows up to twice Limit around a window boundary.
+	FixedWindow Algorithm = iota
+	// SlidingLog records the time of every request and counts those within
+	// the last Window. It is exact, at the cost of one entry per request.
+	SlidingLog
+	// TokenBucket refills Limit tokens per Window and lets bursts of up to
+	// Limit requests through.
+	TokenBucket
+)
+
+// Config configures a Limiter.
+type Config struct {
+	// Prefix is prepended to every key, defaults to "ratelimit_".
+	Prefix    string
+	Algorithm Algorithm
+	// Limit is the number of requests allowed per Window, or the bucket
+	// capacity for TokenBucket.
+	Limit  int64
+	Window time.Duration
+	// FailClosed denies requests when Redis cannot be reached. By default
+	// they are let through.
+	FailClosed bool
+	// Logger receives the errors Middleware gets from Redis, e.g. the
+	// logger given to the store's SetLogger. Nil discards them.
+	Logger redisbackendhttpsessionstore.Logger
+}
+
+// Result is the decision for one request.
+type Result struct {
+	Allowed   bool
+	Limit     int64
+	Remaining int64
+	// RetryAfter is how long to wait before the next request may be
+	// allowed, zero when Allowed.
+	RetryAfter time.Duration
+}
+
+// Limiter decides whether requests are allowed.
+type Limiter struct {
+	client *redis.Client
+	config Config
+	script string
+}
+
+// New returns a limiter using client, typically store.FailoverClient.
+func New(client *redis.Client, config Config) *Limiter {
+	if config.Prefix == "" {
+		config.Prefix = "ratelimit_"
+	}
+	if config.Limit <= 0 {
+		config.Limit = 1
+	}
+	if config.Window <= 0 {
+		config.Window = time.Second
+	}
+	l := &Limiter{client: client, config: config}
+	switch config.Algorithm {
+	case SlidingLog:
+		l.script = slidingLogScript
+	case TokenBucket:
+		l.script = tokenBucketScript
+	default:
+		l.script = fixedWindowScript
+	}
+	return l
+}
+
+// The scripts take the limit and the window in milliseconds and return
+// {allowed, remaining, retry after in milliseconds}.
+
+const fixedWindowScript = `
+local n = redis.call('INCR', KEYS[1])
+if n == 1 then redis.call('PEXPIRE', KEYS[1], ARGV[2]) end
+local limit = tonumber(ARGV[1])
+if n > limit then
+	return {0, 0, redis.call('PTTL', KEYS[1])}
+end
+return {1, limit - n, 0}`
+
+const slidingLogScript = `
+redis.replicate_commands()
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local limit = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - window)
+local n = redis.call('ZCARD', KEYS[1])
+if n >= limit then
+	local oldest = redis.call('ZRANGE', KEYS[1], 0, 0, 'WITHSCORES')
+	return {0, 0, tonumber(oldest[2]) + window - now}
+end
+redis.call('ZADD', KEYS[1], now, now .. '-' .. ARGV[3])
+redis.call('PEXPIRE', KEYS[1], window)
+return {1, limit - n - 1, 0}`
+
+const tokenBucketScript = `
+redis.replicate_commands()
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local capacity = tonumber(ARGV[1])
+local period = tonumber(ARGV[2])
+local rate = capacity / period
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(state[1]) or capacity
+local ts = tonumber(state[2]) or now
+tokens = math.min(capacity, tokens + math.max(0, now - ts) * rate)
+local allowed, retry = 0, 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	retry = math.ceil((1 - tokens) / rate)
+end
+redis.call('HMSET', KEYS[1], 'tokens', tostring(tokens), 'ts', now)
+redis.call('PEXPIRE', KEYS[1], period)
+return {allowed, math.floor(tokens), retry}`
+
+// Allow counts one request for key and returns the decision. When Redis
+// fails, the error is returned together with the decision FailClosed
+// calls for.
+func (l *Limiter) Allow(key string) (Result, error) {
+	result := Result{Limit: l.config.Limit}
+	args := []string{
+		strconv.FormatInt(l.config.Limit, 10),
+		strconv.FormatInt(int64(l.config.Window/time.Millisecond), 10),
+		hex.EncodeToString(securecookie.GenerateRandomKey(8)),
+	}
+	reply, err := l.client.Eval(l.script, []string{l.config.Prefix + key}, args).Result()
+	if err == nil {
+		err = parseReply(reply, &result)
+	}
+	if err != nil {
+		result.Allowed = !l.config.FailClosed
+		return result, err
+	}
+	return result, nil
+}
+
+// Reset forgets the requests counted for key, e.g. after a successful
+// login.
+func (l *Limiter) Reset(key string) error {
+	return l.client.Del(l.config.Prefix + key).Err()
+}
+
+func parseReply(reply interface{}, result *Result) error {
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != 3 {
+		return errors.New("ratelimit: unexpected script reply")
+	}
+	var n [3]int64
+	for i, v := range values {
+		if n[i], ok = v.(int64); !ok {
+			return errors.New("ratelimit: unexpected script reply")
+		}
+	}
+	result.Allowed = n[0] == 1
+	result.Remaining = n[1]
+	result.RetryAfter = time.Duration(n[2]) * time.Millisecond
+	return nil
+}
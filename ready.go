@@ -0,0 +1,96 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package redisbackendhttpsessionstore
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// NotReadyPolicy decides how the store serves requests before the first
+// successful connection to the master.
+type NotReadyPolicy int
+
+const (
+	// NotReadyError makes New and Save return ErrNotReady. New still
+	// returns a fresh session alongside the error.
+	NotReadyError NotReadyPolicy = iota
+	// NotReadyDegraded serves every request with a fresh session and
+	// silently skips Save, so pages keep working without session state.
+	NotReadyDegraded
+)
+
+// ErrNotReady is returned while the store has not reached the master yet
+// and the NotReadyError policy is in effect. It matches
+// ErrBackendUnavailable.
+var ErrNotReady error = unavailableError("SessionStore: backend is not ready")
+
+// Bounds of the delay between connection attempts.
+var (
+	connectMinBackoff = 100 * time.Millisecond
+	connectMaxBackoff = 5 * time.Second
+)
+
+// connect pings the master until it answers and then marks the store as
+// ready. It runs in the background, started by NewSentinelFailoverStore,
+// and gives up when the store is closed.
+func (s *SentinelFailoverStore) connect(done <-chan struct{}) {
+	backoff := connectMinBackoff
+	for attempt := 1; ; attempt++ {
+		pong, err := s.FailoverClient.Ping().Result()
+		if err == nil {
+			s.logger.Log(context.Background(), slog.LevelInfo, "Sentinel connected",
+				"master", s.failoverOption.MasterName, "reply", pong, "attempts", attempt)
+			close(s.ready)
+			return
+		}
+		s.logger.Log(context.Background(), slog.LevelWarn,
+			"Sentinel currently unable to response, retrying",
+			"master", s.failoverOption.MasterName, "error", err,
+			"attempt", attempt, "backoff", backoff)
+		select {
+		case <-done:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > connectMaxBackoff {
+			backoff = connectMaxBackoff
+		}
+	}
+}
+
+// Ready reports whether the store has reached the master.
+func (s *SentinelFailoverStore) Ready() bool {
+	select {
+	case <-s.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// WaitReady blocks until the store has reached the master or ctx is done,
+// in which case it returns ctx.Err(). It returns ErrStoreClosed if the store
+// is closed before it became ready.
+func (s *SentinelFailoverStore) WaitReady(ctx context.Context) error {
+	select {
+	case <-s.ready:
+		return nil
+	case <-s.life.done:
+		return ErrStoreClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,268 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package redisbackendhttpsessionstore
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// ErrRememberMeTheft is returned by Restore when an old validator was
+// replayed. All tokens of the principal are revoked at that point.
+var ErrRememberMeTheft = errors.New("SessionStore: remember-me token reused, all tokens revoked")
+
+// RememberMeConfig configures persistent logins.
+type RememberMeConfig struct {
+	// CookieName defaults to "remember_me".
+	CookieName string
+	// MaxAge is the lifetime of a token, 30 days by default. Every use
+	// extends it.
+	MaxAge time.Duration
+	// SessionMaxAge is the MaxAge in seconds of the sessions minted by
+	// Restore, one hour by default.
+	SessionMaxAge int
+	// Grace is how long the previous validator is still accepted after a
+	// rotation, so parallel requests racing on the same cookie are not
+	// taken for theft. It defaults to 30 seconds.
+	Grace time.Duration
+	// OnTheft is called with the principal whose tokens were revoked.
+	OnTheft func(principal string)
+}
+
+// RememberMe issues and redeems selector/validator tokens. The selector
+// finds the token in Redis, where only a hash of the validator is kept.
+type RememberMe struct {
+	store  *SentinelFailoverStore
+	config RememberMeConfig
+}
+
+// rotateScript checks the validator hash and rotates it. A rotated token
+// stays in the token set of its principal, which gets the token TTL too,
+// so RevokeAll finds it. A replayed token is deleted right away.
+//
+// KEYS[1] is the token. ARGV[1] is the presented hash, ARGV[2] the new
+// hash, ARGV[3] the time and ARGV[4] the grace in milliseconds, ARGV[5]
+// the token TTL in milliseconds, ARGV[6] the selector and ARGV[7] the
+// prefix of the token sets, the principal is only known once the token
+// is read. It returns {status, principal}.
+const rotateScript = `
+local t = redis.call('HMGET', KEYS[1], 'principal', 'hash', 'prev', 'rotated')
+if not t[1] then
+	return {'missing', ''}
+end
+if t[2] == ARGV[1] then
+	local user = ARGV[7] .. t[1]
+	redis.call('HMSET', KEYS[1], 'hash', ARGV[2], 'prev', ARGV[1], 'rotated', ARGV[3])
+	redis.call('PEXPIRE', KEYS[1], ARGV[5])
+	redis.call('SADD', user, ARGV[6])
+	redis.call('PEXPIRE', user, ARGV[5])
+	return {'rotated', t[1]}
+end
+if t[3] == ARGV[1] and tonumber(ARGV[3]) - tonumber(t[4]) <= tonumber(ARGV[4]) then
+	return {'grace', t[1]}
+end
+redis.call('DEL', KEYS[1])
+redis.call('SREM', ARGV[7] .. t[1], ARGV[6])
+return {'theft', t[1]}`
+
+// RememberMe returns the persistent login subsystem of the store.
+func (s *SentinelFailoverStore) RememberMe(config RememberMeConfig) *RememberMe {
+	if config.CookieName == "" {
+		config.CookieName = "remember_me"
+	}
+	if config.MaxAge <= 0 {
+		config.MaxAge = 30 * 24 * time.Hour
+	}
+	if config.SessionMaxAge <= 0 {
+		config.SessionMaxAge = 60 * 60
+	}
+	if config.Grace <= 0 {
+		config.Grace = 30 * time.Second
+	}
+	return &RememberMe{store: s, config: config}
+}
+
+// Issue creates a token for principal and sets its cookie. Call it after
+// a successful sign in with "keep me signed in" checked.
+func (m *RememberMe) Issue(w http.ResponseWriter, r *http.Request, principal string) error {
+	s := m.store
+	selector := hex.EncodeToString(securecookie.GenerateRandomKey(12))
+	validator := securecookie.GenerateRandomKey(32)
+	key := m.tokenKey(selector)
+
+	tx := s.FailoverClient.Multi()
+	defer tx.Close()
+	_, err := tx.Exec(func() error {
+		tx.HMSet(key, "principal", principal, "hash", validatorHash(validator))
+		tx.PExpire(key, m.config.MaxAge)
+		tx.SAdd(m.userKey(principal), selector)
+		tx.PExpire(m.userKey(principal), m.config.MaxAge)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	m.setCookie(w, selector, validator)
+	return nil
+}
+
+// Restore returns the named session of r. If it is new and the request
+// carries a valid token, the token is rotated and a fresh session with
+// SessionMaxAge is minted for its principal through Login.
+//
+// A replayed validator revokes every token of the principal and returns a
+// new session with ErrRememberMeTheft.
+func (m *RememberMe) Restore(w http.ResponseWriter, r *http.Request, name string) (*sessions.Session, error) {
+	s := m.store
+	session, err := s.Get(r, name)
+	if session == nil || !session.IsNew || Principal(session) != "" {
+		return session, err
+	}
+	selector, validator, ok := m.readCookie(r)
+	if !ok {
+		return session, err
+	}
+
+	validator2 := securecookie.GenerateRandomKey(32)
+	reply, err := s.FailoverClient.Eval(rotateScript, []string{m.tokenKey(selector)}, []string{
+		validatorHash(validator),
+		validatorHash(validator2),
+		nowMillis(),
+		strconv.FormatInt(int64(m.config.Grace/time.Millisecond), 10),
+		strconv.FormatInt(int64(m.config.MaxAge/time.Millisecond), 10),
+		selector,
+		m.userKey(""),
+	}).Result()
+	if err != nil {
+		return session, err
+	}
+	var status, principal string
+	if values, ok := reply.([]interface{}); ok && len(values) == 2 {
+		status, _ = values[0].(string)
+		principal, _ = values[1].(string)
+	}
+
+	switch status {
+	case "rotated":
+		m.setCookie(w, selector, validator2)
+	case "grace":
+		// A parallel request rotated the token and set its cookie.
+	case "theft":
+		s.logger.Log(r.Context(), slog.LevelWarn, "remember-me validator replayed, revoking tokens",
+			"op", OpLoad, "principal", principal, "ip", s.clientIP(r))
+		s.metrics.Error(OpLoad, ErrKindTheft)
+		if err := m.RevokeAll(principal); err != nil {
+			return session, err
+		}
+		m.clearCookie(w)
+		if m.config.OnTheft != nil {
+			m.config.OnTheft(principal)
+		}
+		return session, ErrRememberMeTheft
+	default:
+		m.clearCookie(w)
+		return session, nil
+	}
+
+	session.Options.MaxAge = m.config.SessionMaxAge
+	if err := s.Login(r, w, session, principal); err != nil {
+		return session, err
+	}
+	session.IsNew = false
+	s.Audit(r, session, AuditAuthenticated, "method", "remember_me")
+	return session, nil
+}
+
+// Forget deletes the token of r and clears its cookie, e.g. on sign out.
+func (m *RememberMe) Forget(w http.ResponseWriter, r *http.Request) error {
+	defer m.clearCookie(w)
+	selector, _, ok := m.readCookie(r)
+	if !ok {
+		return nil
+	}
+	key := m.tokenKey(selector)
+	principal, err := m.store.FailoverClient.HGet(key, "principal").Result()
+	if err != nil {
+		return nil
+	}
+	m.store.FailoverClient.SRem(m.userKey(principal), selector)
+	return m.store.FailoverClient.Del(key).Err()
+}
+
+// RevokeAll deletes every token of principal. Restore deletes a replayed
+// token itself, before it calls RevokeAll.
+func (m *RememberMe) RevokeAll(principal string) error {
+	selectors, err := m.store.FailoverClient.SMembers(m.userKey(principal)).Result()
+	if err != nil {
+		return err
+	}
+	keys := []string{m.userKey(principal)}
+	for _, selector := range selectors {
+		keys = append(keys, m.tokenKey(selector))
+	}
+	return m.store.FailoverClient.Del(keys...).Err()
+}
+
+func (m *RememberMe) tokenKey(selector string) string {
+	return "remember_" + m.store.keyPrefix + selector
+}
+
+func (m *RememberMe) userKey(principal string) string {
+	return "remember_user_" + m.store.keyPrefix + principal
+}
+
+func (m *RememberMe) setCookie(w http.ResponseWriter, selector string, validator []byte) {
+	opts := *m.store.Options
+	opts.MaxAge = int(m.config.MaxAge / time.Second)
+	opts.HttpOnly = true
+	value := selector + ":" + base64.RawURLEncoding.EncodeToString(validator)
+	http.SetCookie(w, sessions.NewCookie(m.config.CookieName, value, &opts))
+}
+
+func (m *RememberMe) clearCookie(w http.ResponseWriter) {
+	opts := *m.store.Options
+	opts.MaxAge = -1
+	http.SetCookie(w, sessions.NewCookie(m.config.CookieName, "", &opts))
+}
+
+func (m *RememberMe) readCookie(r *http.Request) (string, []byte, bool) {
+	c, err := r.Cookie(m.config.CookieName)
+	if err != nil {
+		return "", nil, false
+	}
+	selector, encoded, ok := strings.Cut(c.Value, ":")
+	if !ok || selector == "" {
+		return "", nil, false
+	}
+	validator, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || len(validator) != 32 {
+		return "", nil, false
+	}
+	return selector, validator, true
+}
+
+func validatorHash(validator []byte) string {
+	sum := sha256.Sum256(validator)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,222 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package redisbackendhttpsessionstore
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+// EvictionPolicy decides what Login does when a principal already holds the
+// maximum number of sessions.
+type EvictionPolicy int
+
+const (
+	// RejectNewLogin makes Login fail with ErrSessionLimit.
+	RejectNewLogin EvictionPolicy = iota
+	// EvictOldest deletes the sessions that logged in first.
+	EvictOldest
+	// EvictLeastRecentlyUsed deletes the sessions loaded least recently.
+	// It costs one extra write per load.
+	EvictLeastRecentlyUsed
+)
+
+// ErrSessionLimit is returned by Login under the RejectNewLogin policy.
+var ErrSessionLimit = errors.New("SessionStore: concurrent session limit reached")
+
+// SessionLimitConfig configures the per-principal session cap.
+type SessionLimitConfig struct {
+	// Max is the number of simultaneous sessions of one principal.
+	Max    int
+	Policy EvictionPolicy
+	// OnEvict is called with the IDs of the sessions a login evicted, so
+	// the application can notify the user. The IDs are hashed if
+	// HashSessionKeys is in effect.
+	OnEvict func(principal string, evicted []string)
+}
+
+// principalKey is the session value holding the principal of Login.
+const principalKey = "_principal"
+
+// registerScript prunes members whose session key is gone, enforces the
+// cap and adds the new session. The session keys are derived from the
+// members inside the script, so concurrent logins see the same members,
+// and evicted sessions are deleted like by Save with a negative MaxAge.
+// It returns the storage ID and the last value of every evicted session.
+//
+// KEYS[1] is the principal set. ARGV[1] is the cap, ARGV[2] "1" to evict,
+// ARGV[3] the new storage ID, ARGV[4] its score, ARGV[5] the TTL of the set
+// in milliseconds, or 0 to leave it, and ARGV[6] the session key prefix.
+const registerScript = deleteSessionLua + `
+for _, id in ipairs(redis.call('ZRANGE', KEYS[1], 0, -1)) do
+	if redis.call('EXISTS', ARGV[6] .. id) == 0 then
+		redis.call('ZREM', KEYS[1], id)
+	end
+end
+local evicted = {}
+if not redis.call('ZSCORE', KEYS[1], ARGV[3]) then
+	local max = tonumber(ARGV[1])
+	local n = redis.call('ZCARD', KEYS[1])
+	if n >= max then
+		if ARGV[2] ~= '1' then
+			return redis.error_reply('SESSION_LIMIT')
+		end
+		for _, id in ipairs(redis.call('ZRANGE', KEYS[1], 0, n - max)) do
+			redis.call('ZREM', KEYS[1], id)
+			table.insert(evicted, id)
+			table.insert(evicted, redis.call('GET', ARGV[6] .. id) or '')
+			delete_session(ARGV[6], id)
+		end
+	end
+end
+redis.call('ZADD', KEYS[1], ARGV[4], ARGV[3])
+if tonumber(ARGV[5]) > 0 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[5])
+end
+return evicted`
+
+// touchScript moves an existing member to the given score.
+const touchScript = `return redis.call('ZADD', KEYS[1], 'XX', ARGV[1], ARGV[2])`
+
+// LimitSessions turns on the per-principal session cap enforced by Login.
+// Logging out through Save with a negative MaxAge releases the slot.
+func (s *SentinelFailoverStore) LimitSessions(config SessionLimitConfig) {
+	if config.Max <= 0 {
+		config.Max = 1
+	}
+	s.sessionLimit = &config
+	s.OnDestroy(func(r *http.Request, session *sessions.Session) {
+		if principal, ok := session.Values[principalKey].(string); ok {
+			s.FailoverClient.ZRem(s.principalSetKey(principal), s.storageID(session.ID))
+		}
+	})
+	if config.Policy == EvictLeastRecentlyUsed {
+		s.OnLoad(func(r *http.Request, session *sessions.Session) {
+			if principal, ok := session.Values[principalKey].(string); ok {
+				s.FailoverClient.Eval(touchScript, []string{s.principalSetKey(principal)},
+					[]string{nowMillis(), s.storageID(session.ID)})
+			}
+		})
+	}
+}
+
+// Login records principal as the owner of session, enforces the session cap
+// and saves the session. Without LimitSessions it only records the owner.
+//
+// Sessions evicted to make room are deleted, audited as AuditRevoked, passed
+// to the OnDestroy hooks and reported to OnEvict.
+func (s *SentinelFailoverStore) Login(r *http.Request, w http.ResponseWriter, session *sessions.Session, principal string) error {
+	session.Values[principalKey] = principal
+	config := s.sessionLimit
+	if config == nil {
+		return s.Save(r, w, session)
+	}
+
+	created := session.ID == ""
+	if created {
+		session.ID = s.newID()
+		s.runHooks(&s.hooks.create, r, session)
+	}
+	set := s.principalSetKey(principal)
+	evict := "0"
+	if config.Policy != RejectNewLogin {
+		evict = "1"
+	}
+	// Without a positive MaxAge the set is left without a TTL, an expiry
+	// of 0 would delete it at once.
+	var ttl int64
+	if s.Options.MaxAge > 0 {
+		ttl = int64(s.Options.MaxAge) * 1000
+	}
+	reply, err := s.FailoverClient.Eval(registerScript, []string{set}, []string{
+		strconv.Itoa(config.Max),
+		evict,
+		s.storageID(session.ID),
+		nowMillis(),
+		strconv.FormatInt(ttl, 10),
+		s.keyPrefix,
+	}).Result()
+	if err != nil {
+		if created {
+			session.ID = ""
+		}
+		if strings.Contains(err.Error(), "SESSION_LIMIT") {
+			return ErrSessionLimit
+		}
+		return err
+	}
+
+	if err := s.Save(r, w, session); err != nil {
+		s.FailoverClient.ZRem(set, s.storageID(session.ID))
+		return err
+	}
+	if created {
+		s.Audit(r, session, AuditCreated)
+	}
+
+	var evicted []string
+	if list, ok := reply.([]interface{}); ok {
+		for i := 0; i+1 < len(list); i += 2 {
+			id, _ := list[i].(string)
+			data, _ := list[i+1].(string)
+			evicted = append(evicted, id)
+			s.evicted(r, session.Name(), principal, id, []byte(data))
+		}
+	}
+	if len(evicted) > 0 && config.OnEvict != nil {
+		config.OnEvict(principal, evicted)
+	}
+	return nil
+}
+
+// evicted audits and runs the OnDestroy hooks for a session Login evicted,
+// given its storage ID and last value. The session handed to them carries
+// the storage ID, which is the hashed ID if HashSessionKeys is in effect,
+// and its values unless it was chunked.
+func (s *SentinelFailoverStore) evicted(r *http.Request, name, principal, sid string, data []byte) {
+	session := sessions.NewSession(s, name)
+	session.ID = sid
+	options := *s.Options
+	options.MaxAge = -1
+	session.Options = &options
+	if _, chunked := chunkCount(data); !chunked && len(data) > 0 {
+		// Hooks get the principal at least.
+		s.serializer.Deserialize(data, session)
+	}
+	session.Values[principalKey] = principal
+	// Failures are logged by Audit, they must not fail the login.
+	s.Audit(r, session, AuditRevoked, "reason", "session_limit")
+	s.runHooks(&s.hooks.destroy, r, session)
+}
+
+// Principal returns the principal recorded by Login, or "".
+func Principal(session *sessions.Session) string {
+	principal, _ := session.Values[principalKey].(string)
+	return principal
+}
+
+func nowMillis() string {
+	return strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10)
+}
+
+// principalSetKey returns the key of the set holding the sessions of a
+// principal, outside the session prefix.
+func (s *SentinelFailoverStore) principalSetKey(principal string) string {
+	return "principal_" + s.keyPrefix + principal
+}
@@ -0,0 +1,143 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package redisbackendhttpsessionstore
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/sessions"
+)
+
+// Transport carries the securecookie encoded session ID between client and
+// server.
+type Transport interface {
+	// Read returns the encoded value of the named session sent with r.
+	Read(r *http.Request, name string) (value string, ok bool)
+	// Write hands value to the client. An empty value with a negative
+	// MaxAge asks the client to forget the session.
+	Write(w http.ResponseWriter, name, value string, options *sessions.Options)
+}
+
+// CookieTransport carries sessions in cookies, the default.
+type CookieTransport struct{}
+
+func (CookieTransport) Read(r *http.Request, name string) (string, bool) {
+	c, err := r.Cookie(name)
+	if err != nil {
+		return "", false
+	}
+	return c.Value, true
+}
+
+func (CookieTransport) Write(w http.ResponseWriter, name, value string, options *sessions.Options) {
+	http.SetCookie(w, sessions.NewCookie(name, value, options))
+}
+
+// HeaderTransport carries sessions in a custom request and response header,
+// e.g. "X-Session-Token". Since a header holds a single value, use one
+// session name per request with it.
+type HeaderTransport struct {
+	Header string
+}
+
+func (t HeaderTransport) Read(r *http.Request, name string) (string, bool) {
+	value := r.Header.Get(t.Header)
+	return value, value != ""
+}
+
+func (t HeaderTransport) Write(w http.ResponseWriter, name, value string, options *sessions.Options) {
+	w.Header().Set(t.Header, value)
+}
+
+// BearerTransport reads sessions from an "Authorization: Bearer" request
+// header and hands them out in ResponseHeader, "X-Session-Token" by
+// default.
+type BearerTransport struct {
+	ResponseHeader string
+}
+
+func (BearerTransport) Read(r *http.Request, name string) (string, bool) {
+	const prefix = "bearer "
+	auth := r.Header.Get("Authorization")
+	if len(auth) <= len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return "", false
+	}
+	return strings.TrimSpace(auth[len(prefix):]), true
+}
+
+func (t BearerTransport) Write(w http.ResponseWriter, name, value string, options *sessions.Options) {
+	header := t.ResponseHeader
+	if header == "" {
+		header = "X-Session-Token"
+	}
+	w.Header().Set(header, value)
+}
+
+// SetTransports sets the transports the store reads sessions from, in
+// order, the first one carrying a value wins. Save answers through that
+// transport only. A session the request did not carry, e.g. on login, is
+// answered through the first transport, unless the handler picks another
+// one with IssueThrough. The default is cookies only.
+//
+//	store.SetTransports(CookieTransport{}, BearerTransport{})
+func (s *SentinelFailoverStore) SetTransports(transports ...Transport) {
+	if len(transports) == 0 {
+		transports = []Transport{CookieTransport{}}
+	}
+	s.transports = transports
+}
+
+type issueTransportKey struct{}
+
+// IssueThrough makes Save answer the sessions r did not carry through t
+// instead of the first transport, e.g. a BearerTransport for an API client
+// logging in. With cookies first, a browser login never sees the session
+// in a header readable by scripts, which HttpOnly cookies are meant to
+// prevent. Like sessions.GetRegistry it updates r in place, so the
+// registry saves with it.
+func IssueThrough(r *http.Request, t Transport) {
+	*r = *r.WithContext(context.WithValue(r.Context(), issueTransportKey{}, t))
+}
+
+// readSession returns the encoded value of the named session and the
+// transport carrying it.
+func (s *SentinelFailoverStore) readSession(r *http.Request, name string) (string, Transport, bool) {
+	for _, t := range s.sessionTransports() {
+		if value, ok := t.Read(r, name); ok {
+			return value, t, true
+		}
+	}
+	return "", nil, false
+}
+
+// writeSession hands value to the client, see SetTransports.
+func (s *SentinelFailoverStore) writeSession(w http.ResponseWriter, r *http.Request, name, value string, options *sessions.Options) {
+	t, _ := r.Context().Value(issueTransportKey{}).(Transport)
+	if _, read, ok := s.readSession(r, name); ok {
+		t = read
+	}
+	if t == nil {
+		t = s.sessionTransports()[0]
+	}
+	t.Write(w, name, value, options)
+}
+
+func (s *SentinelFailoverStore) sessionTransports() []Transport {
+	if len(s.transports) == 0 {
+		return []Transport{CookieTransport{}}
+	}
+	return s.transports
+}
@@ -0,0 +1,133 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package redisbackendhttpsessionstore
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/sessions"
+)
+
+// Validator checks a session right after it was loaded. It returns nil to
+// accept the session, RejectSession or RequireReauthentication otherwise.
+// Any other error is treated as a rejection.
+type Validator func(r *http.Request, session *sessions.Session) error
+
+// ValidationOutcome tells handlers how a validator refused a session.
+type ValidationOutcome int
+
+const (
+	// OutcomeReject means the session was deleted and New returned a
+	// fresh one in its place.
+	OutcomeReject ValidationOutcome = iota + 1
+	// OutcomeReauthenticate means the session was kept, but the user must
+	// prove their identity again before it is trusted.
+	OutcomeReauthenticate
+)
+
+func (o ValidationOutcome) String() string {
+	switch o {
+	case OutcomeReject:
+		return "reject"
+	case OutcomeReauthenticate:
+		return "reauthenticate"
+	}
+	return "unknown"
+}
+
+// ValidationError is returned by New when a validator refused the session.
+// Handlers can branch on it with errors.As:
+//
+//	var verr *ValidationError
+//	if errors.As(err, &verr) && verr.Outcome == OutcomeReauthenticate {
+//		http.Redirect(w, r, "/signin/baseauth", http.StatusFound)
+//	}
+type ValidationError struct {
+	Outcome ValidationOutcome
+	Reason  string
+	// Err is the error of the validator when it did not return a
+	// ValidationError itself.
+	Err error
+}
+
+func (e *ValidationError) Error() string {
+	msg := "SessionStore: session validation failed (" + e.Outcome.String() + ")"
+	if e.Reason != "" {
+		msg += ": " + e.Reason
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// RejectSession returns the error a Validator uses to reject a session.
+func RejectSession(reason string) error {
+	return &ValidationError{Outcome: OutcomeReject, Reason: reason}
+}
+
+// RequireReauthentication returns the error a Validator uses to demand that
+// the user signs in again.
+func RequireReauthentication(reason string) error {
+	return &ValidationError{Outcome: OutcomeReauthenticate, Reason: reason}
+}
+
+// AddValidator appends v to the validators run on every loaded session.
+// Validators run in order; the first one refusing the session decides.
+func (s *SentinelFailoverStore) AddValidator(v Validator) {
+	s.hooks.mu.Lock()
+	defer s.hooks.mu.Unlock()
+	s.hooks.validators = append(s.hooks.validators, v)
+}
+
+// validate runs the validators on a loaded session and returns the
+// session New hands out together with the validation error.
+func (s *SentinelFailoverStore) validate(r *http.Request, session *sessions.Session) (*sessions.Session, error) {
+	s.hooks.mu.RLock()
+	validators := s.hooks.validators
+	s.hooks.mu.RUnlock()
+
+	for _, v := range validators {
+		err := v(r, session)
+		if err == nil {
+			continue
+		}
+		var verr *ValidationError
+		if !errors.As(err, &verr) {
+			verr = &ValidationError{Outcome: OutcomeReject, Err: err}
+		}
+		if verr.Outcome == OutcomeReauthenticate {
+			s.metrics.Error(OpLoad, ErrKindReauthenticate)
+		} else {
+			s.metrics.Error(OpLoad, ErrKindRejected)
+		}
+		s.logError(r.Context(), OpLoad, session.ID, "session refused by validator", verr)
+		if verr.Outcome == OutcomeReauthenticate {
+			return session, verr
+		}
+		// A failed delete is logged by delete, the key expires anyway.
+		s.delete(r.Context(), session)
+		fresh := sessions.NewSession(s, session.Name())
+		opts := *s.Options
+		fresh.Options = &opts
+		fresh.IsNew = true
+		return fresh, verr
+	}
+	return session, nil
+}
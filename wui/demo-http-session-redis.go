@@ -13,6 +13,7 @@ limitations under the License.
 
 package main
 import (
+    "context"
     "fmt"
     "net/http"
     "html/template"
@@ -22,12 +23,18 @@ import (
     "encoding/gob"
     "io/ioutil"
     "os"
+    "os/signal"
+    "syscall"
     "bytes"
+    "log/slog"
+    "time"
     "github.com/spf13/pflag"
     "github.com/gorilla/mux"
     "github.com/gorilla/sessions"
     _ "github.com/gorilla/securecookie"
     redisbackendhttpsessionstore "github.com/stackdocker/http-session-redis-sentinel-backend"
+    "github.com/stackdocker/http-session-redis-sentinel-backend/csrf"
+    "github.com/stackdocker/http-session-redis-sentinel-backend/ratelimit"
     "github.com/boj/redistore"
 )
 
@@ -47,6 +54,7 @@ var (
     templates = make(map[string]*template.Template)
 
     store sessions.Store
+    protector *csrf.Protector
 )
 
 func connectSentinel() (*redisbackendhttpsessionstore.SentinelFailoverStore, error) {
@@ -55,14 +63,28 @@ func connectSentinel() (*redisbackendhttpsessionstore.SentinelFailoverStore, err
     //        MasterName: "mymaster",
     //        Addresses: []string{"104.155.238.248:26379","104.155.202.124:26379"},
     //    }, []byte("something-very-secret"))
+    conf.NotReadyPolicy = redisbackendhttpsessionstore.NotReadyDegraded
     sentinelstore := redisbackendhttpsessionstore.NewSentinelFailoverStore(
         conf, []byte("something-very-secret"))
-
-    pong, err := sentinelstore.FailoverClient.Ping().Result()
-    if err != nil {
-        return nil, err
-    }
-    fmt.Println(pong)
+    sentinelstore.EnableAudit(redisbackendhttpsessionstore.AuditConfig{})
+    sentinelstore.LimitSessions(redisbackendhttpsessionstore.SessionLimitConfig{
+        Max: 3,
+        Policy: redisbackendhttpsessionstore.EvictOldest,
+        OnEvict: func(principal string, evicted []string) {
+            fmt.Println(principal, "signed in elsewhere,", len(evicted), "session(s) evicted")
+        },
+    })
+
+    // Serve pages without sessions until the master is reachable.
+    go func() {
+        ctx, cancel := context.WithTimeout(context.Background(), 2 * time.Minute)
+        defer cancel()
+        if err := sentinelstore.WaitReady(ctx); err != nil {
+            fmt.Println("Sentinel still not ready! Please contact SysOps")
+            return
+        }
+        fmt.Println("Sentinel ready")
+    }()
     return sentinelstore, nil
 }
 
@@ -79,7 +101,8 @@ func main() {
     pflag.Parse()
 
     if sentinelMode {
-        fmt.Println("block to wait connection")
+        conf.Logger = slog.New(slog.NewTextHandler(os.Stdout, nil))
+        fmt.Println("connect in background")
         var err error
         //go func() {store, err = connectSentinel()}()
         store, err = connectSentinel()
@@ -107,13 +130,41 @@ func main() {
         port = "80"
     }
     
+    // Forms carry a token bound to the session, checked on every POST.
+    protector = csrf.New(store, csrf.Options{SessionName: "session-name"})
+
     router := mux.NewRouter()
-    router.HandleFunc("/signup/{signup}", makeHandler(signupHandler)).Methods("GET", "POST")
-    router.HandleFunc("/signin/{signin}", makeHandler(signinHandler)).Methods("GET", "POST")
-    router.HandleFunc("/profile/{profile}", makeHandler(profileHandler)).Methods("GET", "POST")
-    router.HandleFunc("/signout/{signout}", makeHandler(signoutHandler)).Methods("GET", "POST")
+    var signin http.Handler = protector.Middleware(makeHandler(signinHandler))
+    if sentinelstore, ok := store.(*redisbackendhttpsessionstore.SentinelFailoverStore); ok {
+        router.Handle("/healthz", sentinelstore.HealthHandler()).Methods("GET")
+        router.Handle("/livez", sentinelstore.LivenessHandler()).Methods("GET")
+        router.Handle("/readyz", sentinelstore.ReadinessHandler()).Methods("GET")
+
+        // Brute-force protection of sign in attempts, shared by all instances.
+        limiter := ratelimit.New(sentinelstore.FailoverClient, ratelimit.Config{
+            Algorithm: ratelimit.SlidingLog,
+            Limit: 10,
+            Window: time.Minute,
+            Logger: conf.Logger,
+        })
+        byIP := ratelimit.KeyByIP(nil)
+        signin = limiter.Middleware(func(r *http.Request) (string, bool) {
+            if r.Method != "POST" {
+                return "", false
+            }
+            return byIP(r)
+        })(signin)
+    }
+    router.Handle("/signup/{signup}", protector.Middleware(makeHandler(signupHandler))).Methods("GET", "POST")
+    router.Handle("/signin/{signin}", signin).Methods("GET", "POST")
+    router.Handle("/profile/{profile}", protector.Middleware(makeHandler(profileHandler))).Methods("GET", "POST")
+    router.Handle("/signout/{signout}", protector.Middleware(makeHandler(signoutHandler))).Methods("GET", "POST")
     //router.HandleFunc("/index.html", makeHandler(indexHandler)).Methods("GET") // substituted by following statement
-    router.HandleFunc("/{others}", func(w http.ResponseWriter, r *http.Request){
+    // The index page leaves loading and saving its session to the middleware,
+    // which only reads Redis once the handler asks for the session.
+    autosave := redisbackendhttpsessionstore.Middleware(store, "session-name",
+        redisbackendhttpsessionstore.MiddlewareOptions{Lazy: true})
+    router.Handle("/{others}", autosave(protector.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request){
         vars := mux.Vars(r)
         others := vars["others"]
         if m := indexRegex.FindStringSubmatch(strings.ToLower(others)); m != nil {
@@ -121,18 +172,46 @@ func main() {
             return
         }
         http.NotFound(w, r)
-    }).Methods("GET")
+    })))).Methods("GET")
     router.HandleFunc("/", func(w http.ResponseWriter, r *http.Request){
         if r.URL.Path == "/" {
             http.Redirect(w, r, "/index.html", http.StatusFound)
         }
     }).Methods("GET")
 
-    http.Handle("/", router)
     loadTemplates()
-    
+
+    server := &http.Server{Addr: ":" + port, Handler: router}
+    idle := make(chan struct{})
+    go func() {
+        defer close(idle)
+        sigs := make(chan os.Signal, 1)
+        signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+        <-sigs
+
+        ctx, cancel := context.WithTimeout(context.Background(), 30 * time.Second)
+        defer cancel()
+        // Stop accepting requests and let running handlers finish their
+        // session writes before the store connections go away.
+        if err := server.Shutdown(ctx); err != nil {
+            fmt.Println("HTTP server shutdown:", err)
+        }
+        if sentinelstore, ok := store.(*redisbackendhttpsessionstore.SentinelFailoverStore); ok {
+            if err := sentinelstore.Close(ctx); err != nil {
+                fmt.Println("Session store close:", err)
+            }
+        } else if redisstore, ok := store.(*redistore.RediStore); ok {
+            if err := redisstore.Close(); err != nil {
+                fmt.Println("Session store close:", err)
+            }
+        }
+    }()
+
     fmt.Printf("Listening on port %s\n", port)
-    log.Fatal(http.ListenAndServe(":" + port, nil))
+    if err := server.ListenAndServe(); err != http.ErrServerClosed {
+        log.Fatal(err)
+    }
+    <-idle
 }
 
 
@@ -156,13 +235,20 @@ func loadTemplates() {
         template.ParseFiles("tmpl/bye.html", "tmpl/base.html"))
 }
 
-func renderTemplate(w http.ResponseWriter, tmpl string, p *Page) {
+func renderTemplate(w http.ResponseWriter, r *http.Request, tmpl string, p *Page) {
+    p.CSRFField = protector.TemplateField(r)
     err := templates[tmpl + ".html"].ExecuteTemplate(w, "base", p)
     if err != nil {
         http.Error(w, err.Error(), http.StatusInternalServerError)
     }
 }
 
+// sessionError reports whether an error of store.Get must fail the request.
+// A stale or tampered cookie only means the visitor starts over.
+func sessionError(err error) bool {
+    return err != nil && !redisbackendhttpsessionstore.IsCookieError(err)
+}
+
 func makeHandler(fn func(http.ResponseWriter, *http.Request, string)) http.HandlerFunc {
     return func(w http.ResponseWriter, r *http.Request) {
         m := validPath.FindStringSubmatch(r.URL.Path)
@@ -182,11 +268,11 @@ func indexHandler(w http.ResponseWriter, r *http.Request, title string) {
     buf.Reset()
 	logger.Print(r.Method, " ", r.URL.Path, " ", title)
 
-    // Get a session.
-    session, err := store.Get(r, "session-name")
-    if err != nil {
-        logger.Print("exception=", err.Error())
-        http.Error(w, err.Error(), http.StatusInternalServerError)
+    // Get the session loaded by the middleware, which also saves it.
+    session := redisbackendhttpsessionstore.FromContext(r.Context())
+    if err := redisbackendhttpsessionstore.ErrorFromContext(r.Context()); err != nil || session == nil {
+        logger.Print("exception=", err)
+        http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
         fmt.Print(&buf)
         return
     }
@@ -217,9 +303,7 @@ func indexHandler(w http.ResponseWriter, r *http.Request, title string) {
         //not authenticated, signup or signin
         p.Title = "Welcome!"
     
-        // Save it before we write to the response/return from the handler.
-        session.Save(r, w)    
-        renderTemplate(w, "index-login", p)    
+        renderTemplate(w, r, "index-login", p)    
         
         fmt.Print(&buf)
         return
@@ -247,16 +331,13 @@ func indexHandler(w http.ResponseWriter, r *http.Request, title string) {
             //    }
             //}
         }
-        session.Save(r, w) 
-        renderTemplate(w, "index-login", p)    
+        renderTemplate(w, r, "index-login", p)    
         fmt.Print(&buf)
         return
     }
     logger.Print("session=", session.ID)
     p.Title = person.Name
-    // Save it before we write to the response/return from the handler.
-    session.Save(r, w)    
-    renderTemplate(w, "index-logout", p)            
+    renderTemplate(w, r, "index-logout", p)            
     fmt.Print(&buf)
 }
 
@@ -266,7 +347,7 @@ func signupHandler(w http.ResponseWriter, r *http.Request, title string) {
 
     // Get a session.
     session, err := store.Get(r, "session-name")
-    if err != nil {
+    if sessionError(err) {
         logger.Print("exception=", err.Error())
         http.Error(w, err.Error(), http.StatusInternalServerError)
         fmt.Print(&buf)
@@ -302,7 +383,7 @@ func signupHandler(w http.ResponseWriter, r *http.Request, title string) {
                 }
             }
         }
-        renderTemplate(w, "signup", p)
+        renderTemplate(w, r, "signup", p)
         fmt.Print(&buf)
     case "POST":
         logger.Print("validation with file authentication")
@@ -363,7 +444,7 @@ func signinHandler(w http.ResponseWriter, r *http.Request, title string) {
     
     // Get a session.
     session, err := store.Get(r, "session-name")
-    if err != nil {
+    if sessionError(err) {
         logger.Print("exception=", err.Error())
         http.Error(w, err.Error(), 500)
         fmt.Print(&buf)
@@ -403,7 +484,7 @@ func signinHandler(w http.ResponseWriter, r *http.Request, title string) {
             } 
         }
         session.Save(r, w)
-        renderTemplate(w, "signin", p)
+        renderTemplate(w, r, "signin", p)
         fmt.Print(&buf)
         return
     }
@@ -436,8 +517,21 @@ func signinHandler(w http.ResponseWriter, r *http.Request, title string) {
         logger.Print("Authenticated")
         person = &Person {Id: "staging" , Name: r.FormValue("user")} 
         session.Values["person"] = person
-        // Save it before we write to the response/return from the handler.
-        session.Save(r, w)
+        if sentinelstore, ok := store.(*redisbackendhttpsessionstore.SentinelFailoverStore); ok {
+            // Enforce the concurrent session limit, this saves the session.
+            if err := sentinelstore.Login(r, w, session, person.Name); err != nil {
+                logger.Print("-> exception=", err.Error())
+                http.Error(w, err.Error(), http.StatusInternalServerError)
+                fmt.Print(&buf)
+                return
+            }
+            // Audit once saved, so a new session has its ID.
+            sentinelstore.Audit(r, session, redisbackendhttpsessionstore.AuditAuthenticated,
+                "user", person.Name)
+        } else {
+            // Save it before we write to the response/return from the handler.
+            session.Save(r, w)
+        }
         http.Redirect(w, r, "/signin/redir", http.StatusFound)
         fmt.Print(&buf)
         return
@@ -461,7 +555,7 @@ func profileHandler(w http.ResponseWriter, r *http.Request, title string) {
     
     // Get a session.
     session, err := store.Get(r, "session-name")
-    if err != nil {
+    if sessionError(err) {
         logger.Print("exception=", err.Error())
         http.Error(w, err.Error(), 500)
         fmt.Print(&buf)
@@ -505,7 +599,7 @@ func profileHandler(w http.ResponseWriter, r *http.Request, title string) {
     p.Title = person.Name
     p.Body = []byte(person.Id)
     session.Save(r, w)
-    renderTemplate(w, "profile", p)
+    renderTemplate(w, r, "profile", p)
     fmt.Print(&buf)
 }
 
@@ -515,7 +609,7 @@ func signoutHandler(w http.ResponseWriter, r *http.Request, title string) {
 	
     // Get a session.
     session, err := store.Get(r, "session-name")
-    if err != nil {
+    if sessionError(err) {
         logger.Print(err.Error())
         http.Error(w, err.Error(), 500)
         fmt.Print(&buf)
@@ -586,7 +680,7 @@ func signoutHandler(w http.ResponseWriter, r *http.Request, title string) {
             }
         }
         //session.Save(r, w)
-        renderTemplate(w, "bye", p)
+        renderTemplate(w, r, "bye", p)
         fmt.Print(&buf)
         return
     }
@@ -608,6 +702,7 @@ type Person struct {
 type Page struct {
 	Title string
 	Body  []byte
+	CSRFField template.HTML
 }
 
 func (p *Page) save() error {